@@ -1,11 +1,17 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 
 	"github.com/daohoangson/go-deferred/pkg/daemon"
+	"github.com/daohoangson/go-deferred/pkg/runner"
+	"github.com/daohoangson/go-deferred/pkg/store"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 func main() {
@@ -15,13 +21,79 @@ func main() {
 		os.Exit(1)
 	}
 
-	port, err := strconv.ParseUint(args[1], 10, 16)
-	if err != nil {
-		fmt.Printf("Could not parse port %s (%s)\n", args[1], err)
-		os.Exit(1)
+	var port uint64
+	if len(args[1]) > 0 {
+		var err error
+		port, err = strconv.ParseUint(args[1], 10, 16)
+		if err != nil {
+			fmt.Printf("Could not parse port %s (%s)\n", args[1], err)
+			os.Exit(1)
+		}
+	}
+
+	r := runner.New(nil, nil)
+	if f, ok := r.(runner.Failable); ok {
+		if err := f.GetInitError(); err != nil {
+			fmt.Printf("Could not set up runner (%s)\n", err)
+			os.Exit(1)
+		}
 	}
 
-	d := daemon.New(nil, nil)
+	d := daemon.New(r, nil)
 	d.SetSecret(args[2])
-	d.ListenAndServe(port)
+
+	storeFile := os.Getenv("DEFERMON_STORE_FILE")
+	if len(storeFile) > 0 {
+		s, err := store.NewFile(storeFile)
+		if err != nil {
+			fmt.Printf("Could not open store %s (%s)\n", storeFile, err)
+			os.Exit(1)
+		}
+		d.SetStore(s)
+	}
+
+	storeRedis := os.Getenv("DEFERMON_STORE_REDIS")
+	if len(storeRedis) > 0 {
+		s, err := store.NewRedis(storeRedis, os.Getenv("DEFERMON_STORE_REDIS_PREFIX"))
+		if err != nil {
+			fmt.Printf("Could not connect to store %s (%s)\n", storeRedis, err)
+			os.Exit(1)
+		}
+		d.SetStore(s)
+	}
+
+	storeSQL := os.Getenv("DEFERMON_STORE_SQL")
+	if len(storeSQL) > 0 {
+		driver := os.Getenv("DEFERMON_STORE_SQL_DRIVER")
+		db, err := sql.Open(driver, storeSQL)
+		if err != nil {
+			fmt.Printf("Could not open store %s (%s)\n", driver, err)
+			os.Exit(1)
+		}
+
+		s, err := store.NewSQL(db, driver, os.Getenv("DEFERMON_STORE_SQL_PREFIX"))
+		if err != nil {
+			fmt.Printf("Could not prepare store %s (%s)\n", driver, err)
+			os.Exit(1)
+		}
+		d.SetStore(s)
+	}
+
+	config := daemon.ListenConfig{
+		Socket:   os.Getenv("DEFERMON_SOCKET"),
+		CertFile: os.Getenv("DEFERMON_TLS_CERT"),
+		KeyFile:  os.Getenv("DEFERMON_TLS_KEY"),
+	}
+	bind := os.Getenv("DEFERMON_BIND")
+	if port > 0 || len(bind) > 0 {
+		// without a port, the daemon may listen on the socket only
+		config.Address = net.JoinHostPort(bind, strconv.FormatUint(port, 10))
+	}
+	http2 := os.Getenv("DEFERMON_HTTP2")
+	config.DisableHTTP2 = http2 == "false" || http2 == "no" || http2 == "0"
+
+	if err := d.Listen(config); err != nil {
+		fmt.Printf("Could not listen (%s)\n", err)
+		os.Exit(1)
+	}
 }
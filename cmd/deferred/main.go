@@ -1,45 +1,177 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/daohoangson/go-deferred/internal"
 	"github.com/daohoangson/go-deferred/pkg/runner"
 )
 
+const (
+	exitCodeOK    = 0
+	exitCodeUsage = 1
+	exitCodeError = 2
+)
+
+var parallel uint
+
+var (
+	cooldown             = flag.Duration("cooldown", time.Minute, "wait after a failed hit, overrides DEFERRED_COOLDOWN_DURATION")
+	errorsBeforeQuitting = flag.Uint64("errors-before-quitting", 3, "consecutive failed hits before giving up on a target, overrides DEFERRED_ERRORS_BEFORE_QUITTING")
+	file                 = flag.String("file", "", "read target URLs from this file, one per line, - for stdin")
+	interval             = flag.Duration("interval", time.Minute, "with -watch, wait between loops of a target unless it asks for another time")
+	maxHits              = flag.Uint64("max-hits", 5, "max hits per target, 0 for no limit, overrides DEFERRED_MAX_HITS_PER_LOOP")
+	maxLoopDuration      = flag.Duration("max-loop-duration", 0, "time budget of each loop, 0 for no limit, overrides DEFERRED_MAX_LOOP_DURATION")
+	minHitInterval       = flag.Duration("min-hit-interval", 0, "min time between the starts of two hits of a target, overrides DEFERRED_MIN_HIT_INTERVAL")
+	probe                = flag.Bool("probe", false, "hit each target once without looping and check that it speaks the protocol")
+	report               = flag.String("report", reportText, "format of the results: "+strings.Join(reportFormats, ", "))
+	serializeHosts       = flag.Bool("serialize-hosts", false, "loop targets of the same host one after another")
+	timeout              = flag.Duration("timeout", time.Minute+time.Second, "timeout of each hit, overrides DEFERRED_HTTP_CLIENT_TIMEOUT")
+	watch                = flag.Bool("watch", false, "keep looping each target until SIGINT or SIGTERM, then report the last loops")
+)
+
+func init() {
+	flag.UintVar(&parallel, "parallel", 0, "max targets to loop at the same time, 0 for all of them")
+	flag.UintVar(&parallel, "concurrency", 0, "alias of -parallel")
+}
+
 func main() {
-	args := os.Args
-	if len(args) < 2 {
-		fmt.Printf("Usage: %s http://domain.com/xenforo/deferred.php [url2] [url3] ...\n", args[0])
-		os.Exit(1)
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	flag.Usage = usage
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(exitCodeOK)
+		}
+		os.Exit(exitCodeUsage)
+	}
+
+	if !isValidReport(*report) {
+		fmt.Fprintf(os.Stderr, "Unknown report format %s\n", *report)
+		os.Exit(exitCodeUsage)
+	}
+
+	urls := flag.Args()
+	if len(*file) > 0 {
+		fileURLs, err := readURLFile(*file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read %s (%s)\n", *file, err)
+			os.Exit(exitCodeUsage)
+		}
+		urls = append(urls, fileURLs...)
+	}
+
+	if len(urls) == 0 {
+		flag.Usage()
+		os.Exit(exitCodeUsage)
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if set["timeout"] {
+		internal.GetHTTPClient().Timeout = *timeout
+	}
+
+	if *probe {
+		if *report != reportText && *report != reportJSON {
+			fmt.Fprintf(os.Stderr, "Report format %s is not available for probes\n", *report)
+			os.Exit(exitCodeUsage)
+		}
+
+		ok, err := runProbes(os.Stdout, urls, *report)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write report (%s)\n", err)
+		}
+		if err != nil || !ok {
+			os.Exit(exitCodeError)
+		}
+		os.Exit(exitCodeOK)
 	}
 
-	urlCount := len(args) - 1
-	exitCodes := make(chan int, urlCount)
 	r := runner.New(nil, nil)
+	if f, ok := r.(runner.Failable); ok {
+		if err := f.GetInitError(); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not set up runner (%s)\n", err)
+			os.Exit(exitCodeError)
+		}
+	}
+	if c, ok := r.(runner.Configurable); ok {
+		if set["cooldown"] {
+			c.SetCooldownDuration(*cooldown)
+		}
+		if set["errors-before-quitting"] {
+			c.SetErrorsBeforeQuitting(*errorsBeforeQuitting)
+		}
+		if set["max-hits"] {
+			c.SetMaxHitsPerLoop(*maxHits)
+		}
+		if set["max-loop-duration"] {
+			c.SetMaxLoopDuration(*maxLoopDuration)
+		}
+		if set["min-hit-interval"] {
+			c.SetMinHitInterval(*minHitInterval)
+		}
+	}
 
-	for i := 0; i < urlCount; i++ {
-		url := args[i+1]
-		go func(workerID int, url string, exitCodes chan int) {
-			_, err := runner.Loop(r, url)
+	loop := func(url string) (runner.Hits, error) {
+		return runner.Loop(r, url)
+	}
 
-			exitCode := 0
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error processing %s: %s\n", url, err)
-				exitCode = 2
-			}
+	var results []result
+	if *watch {
+		stop := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			fmt.Fprintf(os.Stderr, "Received %s, waiting for running loops (send again to quit now)...\n", sig)
+			close(stop)
 
-			exitCodes <- exitCode
-		}(i, url, exitCodes)
+			sig = <-signals
+			fmt.Fprintf(os.Stderr, "Received %s again, quitting\n", sig)
+			os.Exit(exitCodeError)
+		}()
+
+		results = runWatch(urls, parallel, *serializeHosts, *interval, r.GetClock(), stop, loop)
+	} else {
+		results = runPool(urls, parallel, *serializeHosts, loop)
 	}
 
-	summaryExitCode := 0
-	for i := 0; i < urlCount; i++ {
-		exitCode := <-exitCodes
-		if exitCode > summaryExitCode {
-			summaryExitCode = exitCode
+	summaryExitCode := exitCodeOK
+	for _, result := range results {
+		if result.Error != nil {
+			fmt.Fprintf(os.Stderr, "Error processing %s: %s\n", result.URL, result.Error)
+
+			// failed loops are retried in watch mode so they do not fail a clean shutdown
+			if !*watch {
+				summaryExitCode = exitCodeError
+			}
 		}
 	}
 
+	if err := writeReport(os.Stdout, *report, results); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write report (%s)\n", err)
+		summaryExitCode = exitCodeError
+	}
+
 	os.Exit(summaryExitCode)
 }
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [options] http://domain.com/xenforo/deferred.php [url2] [url3] ...\n\n", os.Args[0])
+	fmt.Fprintf(out, "Loop through each target until there is nothing left, then report each target in the given order.\n")
+	fmt.Fprintf(out, "Target URLs may also be read from a file, blank lines and lines starting with # are ignored.\n\n")
+	fmt.Fprintf(out, "Options:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\nExit codes:\n")
+	fmt.Fprintf(out, "  %d  all targets have been processed, watch mode has stopped, or help was requested\n", exitCodeOK)
+	fmt.Fprintf(out, "  %d  invalid options or no target\n", exitCodeUsage)
+	fmt.Fprintf(out, "  %d  some target could not be processed, or failed its probe\n", exitCodeError)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/daohoangson/go-deferred/pkg/runner"
+)
+
+type result struct {
+	URL   string
+	Hits  runner.Hits
+	Error error
+}
+
+type loopFunc func(url string) (runner.Hits, error)
+
+// runPool loops through the URLs with at most parallel workers, 0 for one worker per group.
+// With serializeHosts, URLs of the same host are looped one after another by the same worker.
+// Results are in the same order as the URLs regardless of completion order.
+func runPool(urls []string, parallel uint, serializeHosts bool, loop loopFunc) []result {
+	results := make([]result, len(urls))
+	groups := groupURLs(urls, serializeHosts)
+
+	workers := int(parallel)
+	if workers == 0 || workers > len(groups) {
+		workers = len(groups)
+	}
+
+	jobs := make(chan []int, len(groups))
+	for _, group := range groups {
+		jobs <- group
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for group := range jobs {
+				for _, index := range group {
+					// each index is written by exactly one worker
+					hits, err := loop(urls[index])
+					results[index] = result{URL: urls[index], Hits: hits, Error: err}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// groupURLs returns indexes of the URLs, grouped by host if serializeHosts
+func groupURLs(urls []string, serializeHosts bool) [][]int {
+	var groups [][]int
+	hostGroups := make(map[string]int)
+
+	for index, u := range urls {
+		if serializeHosts {
+			host := getHost(u)
+			if groupIndex, ok := hostGroups[host]; ok {
+				groups[groupIndex] = append(groups[groupIndex], index)
+				continue
+			}
+			hostGroups[host] = len(groups)
+		}
+
+		groups = append(groups, []int{index})
+	}
+
+	return groups
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daohoangson/go-deferred/pkg/runner"
+	"github.com/stretchr/testify/assert"
+)
+
+type poolRecorder struct {
+	mutex       sync.Mutex
+	running     int
+	maxRunning  int
+	hostRunning map[string]int
+	hostOverlap bool
+}
+
+func (p *poolRecorder) loop(u string) (runner.Hits, error) {
+	parsed, _ := url.Parse(u)
+
+	p.mutex.Lock()
+	p.running++
+	if p.running > p.maxRunning {
+		p.maxRunning = p.running
+	}
+	p.hostRunning[parsed.Host]++
+	if p.hostRunning[parsed.Host] > 1 {
+		p.hostOverlap = true
+	}
+	p.mutex.Unlock()
+
+	// later URLs finish first
+	time.Sleep(time.Duration(10-len(u)%10) * time.Millisecond)
+
+	p.mutex.Lock()
+	p.running--
+	p.hostRunning[parsed.Host]--
+	p.mutex.Unlock()
+
+	if parsed.Path == "/fail" {
+		return runner.Hits{}, errors.New("fail")
+	}
+
+	return runner.Hits{List: []runner.Hit{runner.Hit{}}}, nil
+}
+
+func TestRunPool(t *testing.T) {
+	urls := []string{
+		"http://a.com/1",
+		"http://a.com/22",
+		"http://b.com/333",
+		"http://b.com/fail",
+		"http://c.com/55555",
+		"http://d.com/666666",
+	}
+
+	p := &poolRecorder{hostRunning: make(map[string]int)}
+	results := runPool(urls, 2, false, p.loop)
+
+	assert.Equal(t, 2, p.maxRunning)
+	assert.Equal(t, len(urls), len(results))
+	for i, result := range results {
+		assert.Equal(t, urls[i], result.URL)
+		if i == 3 {
+			assert.NotNil(t, result.Error)
+		} else {
+			assert.Nil(t, result.Error)
+			assert.Equal(t, 1, len(result.Hits.List))
+		}
+	}
+}
+
+func TestRunPoolSerializeHosts(t *testing.T) {
+	urls := []string{
+		"http://a.com/1",
+		"http://b.com/22",
+		"http://a.com/333",
+		"http://b.com/4444",
+		"http://a.com/55555",
+	}
+
+	p := &poolRecorder{hostRunning: make(map[string]int)}
+	results := runPool(urls, 0, true, p.loop)
+
+	assert.False(t, p.hostOverlap)
+	assert.Equal(t, 2, p.maxRunning)
+	for i, result := range results {
+		assert.Equal(t, urls[i], result.URL)
+	}
+}
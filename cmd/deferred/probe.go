@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/daohoangson/go-deferred/pkg/runner"
+)
+
+type probeReport struct {
+	runner.ProbeResult
+	Error string `json:"error,omitempty"`
+}
+
+// runProbes probes the URLs in order, it returns true if all of them speak the protocol
+func runProbes(w io.Writer, urls []string, format string) (bool, error) {
+	reports := make([]probeReport, len(urls))
+	ok := true
+	for i, url := range urls {
+		result, err := runner.Probe(nil, url)
+		reports[i] = probeReport{ProbeResult: result}
+		if err != nil {
+			reports[i].Error = err.Error()
+		}
+
+		ok = ok && err == nil && result.Valid
+	}
+
+	if format == reportJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return ok, encoder.Encode(reports)
+	}
+
+	for _, report := range reports {
+		if err := writeProbeText(w, report); err != nil {
+			return ok, err
+		}
+	}
+
+	return ok, nil
+}
+
+func writeProbeText(w io.Writer, report probeReport) error {
+	lines := []string{report.URL}
+	if len(report.Error) > 0 {
+		lines = append(lines, fmt.Sprintf("  error: %s", report.Error))
+	} else {
+		flavour := string(report.Flavour)
+		if len(flavour) == 0 {
+			flavour = "unknown"
+		}
+		protocolVersion := report.ProtocolVersion
+		if len(protocolVersion) == 0 {
+			protocolVersion = "not supported"
+		}
+
+		lines = append(lines,
+			fmt.Sprintf("  valid: %t", report.Valid),
+			fmt.Sprintf("  status: %d %s", report.StatusCode, report.ContentType),
+			fmt.Sprintf("  flavour: %s", flavour),
+			fmt.Sprintf("  protocol version: %s", protocolVersion),
+			fmt.Sprintf("  latency: %s (%s with body)", report.Latency, report.Elapsed),
+		)
+		if report.Enqueue != nil {
+			lines = append(lines, fmt.Sprintf("  enqueue: %d", *report.Enqueue))
+		}
+		if len(report.Data.Message) > 0 {
+			lines = append(lines, fmt.Sprintf("  message: %s", report.Data.Message))
+		}
+		if t := report.TLS; t != nil {
+			verified := "verified"
+			if !t.Verified {
+				verified = "not verified: " + t.VerifyError
+			}
+			lines = append(lines,
+				fmt.Sprintf("  tls: %s, cipher suite %s, protocol %q", t.Version, t.CipherSuite, t.Protocol),
+				fmt.Sprintf("  certificate: %s, issued by %s, expires %s, %s", t.Subject, t.Issuer, t.NotAfter, verified),
+			)
+		}
+		for _, problem := range report.Problems {
+			lines = append(lines, fmt.Sprintf("  problem: %s", problem))
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "%s\n", strings.Join(lines, "\n"))
+	return err
+}
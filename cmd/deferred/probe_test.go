@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/daohoangson/go-deferred/pkg/testserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunProbes(t *testing.T) {
+	s := testserver.New(1)
+	defer s.Close()
+
+	var b bytes.Buffer
+	ok, err := runProbes(&b, []string{s.GetDeferredURL(), s.GetJobURL()}, reportText)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Contains(t, b.String(), "  flavour: xf1\n")
+	assert.Contains(t, b.String(), "  flavour: xf2\n")
+	assert.Contains(t, b.String(), "  protocol version: not supported\n")
+
+	s.SetConfig(testserver.Config{Malformed: true})
+	b.Reset()
+	ok, err = runProbes(&b, []string{s.GetDeferredURL()}, reportJSON)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Contains(t, b.String(), `"valid": false`)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+)
+
+type targetReport struct {
+	URL         string  `json:"url"`
+	OK          bool    `json:"ok"`
+	Hits        int     `json:"hits"`
+	Elapsed     float64 `json:"elapsed"`
+	StopReason  string  `json:"stop_reason"`
+	LastMessage string  `json:"last_message,omitempty"`
+	Enqueue     *int64  `json:"enqueue,omitempty"`
+	Remaining   *uint64 `json:"remaining,omitempty"`
+	Error       string  `json:"error,omitempty"`
+	ErrorType   string  `json:"error_type,omitempty"`
+}
+
+type junitTestSuite struct {
+	XMLName  xml.Name        `xml:"testsuite"`
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     float64         `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Type    string `xml:"type,attr"`
+	Message string `xml:"message,attr"`
+}
+
+const (
+	reportJSON  = "json"
+	reportJUnit = "junit"
+	reportTAP   = "tap"
+	reportText  = "text"
+)
+
+// Error types of a target report
+const (
+	errorTypeConnection = "connection"
+	errorTypeOther      = "other"
+	errorTypeParse      = "parse"
+	errorTypeTimeout    = "timeout"
+)
+
+var reportFormats = []string{reportText, reportJSON, reportJUnit, reportTAP}
+
+func isValidReport(format string) bool {
+	for _, f := range reportFormats {
+		if f == format {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newTargetReport(r result) targetReport {
+	report := targetReport{
+		URL:        r.URL,
+		OK:         r.Error == nil,
+		Hits:       len(r.Hits.List),
+		Elapsed:    r.Hits.TimeElapsed.Seconds(),
+		StopReason: string(r.Hits.StopReason),
+	}
+
+	for _, hit := range r.Hits.List {
+		if len(hit.Data.Message) > 0 {
+			report.LastMessage = hit.Data.Message
+		}
+		if hit.HasEnqueue {
+			enqueue := hit.Enqueue
+			report.Enqueue = &enqueue
+		}
+		if hit.Data.Progress != nil {
+			report.Remaining = hit.Data.Progress.Remaining
+		}
+	}
+
+	if r.Error != nil {
+		report.Error = r.Error.Error()
+		report.ErrorType = getErrorType(r.Error)
+	}
+
+	return report
+}
+
+// getErrorType classifies a loop error for reports
+func getErrorType(err error) string {
+	if urlErr, ok := err.(*url.Error); ok {
+		if urlErr.Timeout() {
+			return errorTypeTimeout
+		}
+
+		return errorTypeConnection
+	}
+
+	if netErr, ok := err.(net.Error); ok {
+		if netErr.Timeout() {
+			return errorTypeTimeout
+		}
+
+		return errorTypeConnection
+	}
+
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return errorTypeParse
+	}
+
+	return errorTypeOther
+}
+
+func writeReport(w io.Writer, format string, results []result) error {
+	if format == reportText {
+		return writeReportText(w, results)
+	}
+
+	reports := make([]targetReport, len(results))
+	for i, r := range results {
+		reports[i] = newTargetReport(r)
+	}
+
+	switch format {
+	case reportJSON:
+		return writeReportJSON(w, reports)
+	case reportJUnit:
+		return writeReportJUnit(w, reports)
+	}
+
+	return writeReportTAP(w, reports)
+}
+
+func writeReportJSON(w io.Writer, reports []targetReport) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(reports)
+}
+
+func writeReportJUnit(w io.Writer, reports []targetReport) error {
+	suite := junitTestSuite{Name: "deferred", Tests: len(reports)}
+	for _, report := range reports {
+		testCase := junitTestCase{
+			Name:      report.URL,
+			ClassName: "deferred",
+			Time:      report.Elapsed,
+			SystemOut: report.LastMessage,
+		}
+		if !report.OK {
+			testCase.Failure = &junitFailure{Type: report.ErrorType, Message: report.Error}
+			suite.Failures++
+		}
+
+		suite.Cases = append(suite.Cases, testCase)
+		suite.Time += report.Elapsed
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(suite); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func writeReportTAP(w io.Writer, reports []targetReport) error {
+	if _, err := fmt.Fprintf(w, "TAP version 13\n1..%d\n", len(reports)); err != nil {
+		return err
+	}
+
+	for i, report := range reports {
+		status := "ok"
+		if !report.OK {
+			status = "not ok"
+		}
+		if _, err := fmt.Fprintf(w, "%s %d - %s\n", status, i+1, report.URL); err != nil {
+			return err
+		}
+
+		// YAML block with the details, as understood by most TAP consumers
+		lines := []string{
+			fmt.Sprintf("hits: %d", report.Hits),
+			fmt.Sprintf("elapsed: %g", report.Elapsed),
+			fmt.Sprintf("stop_reason: %q", report.StopReason),
+		}
+		if len(report.LastMessage) > 0 {
+			lines = append(lines, fmt.Sprintf("last_message: %q", report.LastMessage))
+		}
+		if report.Enqueue != nil {
+			lines = append(lines, fmt.Sprintf("enqueue: %d", *report.Enqueue))
+		}
+		if report.Remaining != nil {
+			lines = append(lines, fmt.Sprintf("remaining: %d", *report.Remaining))
+		}
+		if !report.OK {
+			lines = append(lines, fmt.Sprintf("error: %q", report.Error), fmt.Sprintf("error_type: %s", report.ErrorType))
+		}
+		if _, err := fmt.Fprintf(w, "  ---\n  %s\n  ...\n", strings.Join(lines, "\n  ")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeReportText(w io.Writer, results []result) error {
+	for _, r := range results {
+		status := "ok"
+		if r.Error != nil {
+			status = "error"
+		}
+
+		if _, err := fmt.Fprintf(w, "%s\t%s\thits=%d\treason=%s\telapsed=%s\n", status, r.URL,
+			len(r.Hits.List), r.Hits.StopReason, r.Hits.TimeElapsed); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
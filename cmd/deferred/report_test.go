@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daohoangson/go-deferred/pkg/runner"
+	"github.com/stretchr/testify/assert"
+)
+
+func testResults() []result {
+	return []result{
+		result{
+			URL: "http://a.com/deferred.php",
+			Hits: runner.Hits{
+				List: []runner.Hit{
+					runner.Hit{Data: runner.Data{Message: "Rebuilding", MoreDeferred: true}},
+					runner.Hit{Enqueue: 30, HasEnqueue: true},
+				},
+				StopReason:  runner.StopReasonNoMore,
+				TimeElapsed: 1500 * time.Millisecond,
+			},
+		},
+		result{
+			URL: "http://b.com/deferred.php",
+			Hits: runner.Hits{
+				List:       []runner.Hit{runner.Hit{}},
+				StopReason: runner.StopReasonErrors,
+			},
+			Error: &url.Error{Op: "Post", URL: "http://b.com/deferred.php", Err: errors.New("connection refused")},
+		},
+	}
+}
+
+func TestGetErrorType(t *testing.T) {
+	assert.Equal(t, errorTypeConnection, getErrorType(&url.Error{Err: errors.New("refused")}))
+	assert.Equal(t, errorTypeParse, getErrorType(json.Unmarshal([]byte("<html>"), &runner.Data{})))
+	assert.Equal(t, errorTypeOther, getErrorType(errors.New("other")))
+}
+
+func TestReportJSON(t *testing.T) {
+	var b bytes.Buffer
+	assert.Nil(t, writeReport(&b, reportJSON, testResults()))
+
+	var reports []targetReport
+	assert.Nil(t, json.Unmarshal(b.Bytes(), &reports))
+	assert.Equal(t, 2, len(reports))
+
+	assert.True(t, reports[0].OK)
+	assert.Equal(t, 2, reports[0].Hits)
+	assert.Equal(t, 1.5, reports[0].Elapsed)
+	assert.Equal(t, "no_more", reports[0].StopReason)
+	assert.Equal(t, "Rebuilding", reports[0].LastMessage)
+	if assert.NotNil(t, reports[0].Enqueue) {
+		assert.Equal(t, int64(30), *reports[0].Enqueue)
+	}
+
+	assert.False(t, reports[1].OK)
+	assert.Nil(t, reports[1].Enqueue)
+	assert.Equal(t, errorTypeConnection, reports[1].ErrorType)
+	assert.Contains(t, reports[1].Error, "connection refused")
+}
+
+func TestReportJUnit(t *testing.T) {
+	var b bytes.Buffer
+	assert.Nil(t, writeReport(&b, reportJUnit, testResults()))
+
+	var suite junitTestSuite
+	assert.Nil(t, xml.Unmarshal(b.Bytes(), &suite))
+	assert.Equal(t, 2, suite.Tests)
+	assert.Equal(t, 1, suite.Failures)
+	assert.Nil(t, suite.Cases[0].Failure)
+	if assert.NotNil(t, suite.Cases[1].Failure) {
+		assert.Equal(t, errorTypeConnection, suite.Cases[1].Failure.Type)
+	}
+}
+
+func TestReportTAP(t *testing.T) {
+	var b bytes.Buffer
+	assert.Nil(t, writeReport(&b, reportTAP, testResults()))
+
+	tap := b.String()
+	assert.True(t, strings.HasPrefix(tap, "TAP version 13\n1..2\n"))
+	assert.Contains(t, tap, "ok 1 - http://a.com/deferred.php\n")
+	assert.Contains(t, tap, "  enqueue: 30\n")
+	assert.Contains(t, tap, "not ok 2 - http://b.com/deferred.php\n")
+	assert.Contains(t, tap, "  error_type: connection\n")
+}
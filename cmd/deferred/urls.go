@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// readURLFile reads target URLs from path, or from stdin if path is -
+func readURLFile(path string) ([]string, error) {
+	if path == "-" {
+		return readURLs(os.Stdin)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readURLs(f)
+}
+
+// readURLs returns one URL per line, skipping blank lines and # comments
+func readURLs(r io.Reader) ([]string, error) {
+	var urls []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, " #"); i > -1 {
+			line = line[:i]
+		}
+
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		urls = append(urls, line)
+	}
+
+	return urls, scanner.Err()
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadURLs(t *testing.T) {
+	urls, err := readURLs(strings.NewReader(`# production
+https://xfrocks.com/deferred.php
+
+  https://tinhte.vn/deferred.php  # forum
+#https://disabled.com/deferred.php
+http://domain.com/job.php#fragment
+`))
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"https://xfrocks.com/deferred.php",
+		"https://tinhte.vn/deferred.php",
+		"http://domain.com/job.php#fragment",
+	}, urls)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/daohoangson/go-deferred/pkg/clock"
+	"github.com/daohoangson/go-deferred/pkg/runner"
+)
+
+// runWatch keeps looping through each URL until stop is closed, it waits for running loops before returning.
+// The next loop of a URL is due as hinted by its last hit, or after interval, a stop hint ends the URL.
+// Results are the last ones of each URL, in the same order as the URLs.
+func runWatch(urls []string, parallel uint, serializeHosts bool, interval time.Duration,
+	c clock.Clock, stop <-chan struct{}, loop loopFunc) []result {
+	results := make([]result, len(urls))
+	for index, u := range urls {
+		results[index].URL = u
+	}
+	var resultsMutex sync.Mutex
+
+	var slots chan struct{}
+	if parallel > 0 {
+		slots = make(chan struct{}, parallel)
+	}
+
+	// one slot per host, it is taken before the pool slot so that URLs waiting for a busy host
+	// do not hold pool slots that URLs of other hosts could use
+	hostSlots := make(map[string]chan struct{})
+	if serializeHosts {
+		for _, u := range urls {
+			host := getHost(u)
+			if _, ok := hostSlots[host]; !ok {
+				hostSlots[host] = make(chan struct{}, 1)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for index, u := range urls {
+		wg.Add(1)
+		go func(index int, u string) {
+			defer wg.Done()
+			hostSlot := hostSlots[getHost(u)]
+
+			for {
+				if !acquireSlot(hostSlot, stop) {
+					return
+				}
+				if !acquireSlot(slots, stop) {
+					releaseSlot(hostSlot)
+					return
+				}
+
+				hits, err := loop(u)
+
+				releaseSlot(slots)
+				releaseSlot(hostSlot)
+
+				resultsMutex.Lock()
+				results[index] = result{URL: u, Hits: hits, Error: err}
+				resultsMutex.Unlock()
+
+				delay, ok := getNextDelay(hits, err, interval)
+				if !ok {
+					// the target has no more work, there is no /queue to resume it
+					return
+				}
+
+				select {
+				case <-c.After(delay):
+				case <-stop:
+					return
+				}
+			}
+		}(index, u)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func acquireSlot(slots chan struct{}, stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+
+	if slots == nil {
+		return true
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+func releaseSlot(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+func getHost(u string) string {
+	if parsed, err := url.Parse(u); err == nil && len(parsed.Host) > 0 {
+		return parsed.Host
+	}
+
+	return u
+}
+
+// getNextDelay follows the enqueue header of the last hit like the daemon does,
+// it returns false if the target asked to stop
+func getNextDelay(hits runner.Hits, err error, interval time.Duration) (time.Duration, bool) {
+	if err != nil || len(hits.List) == 0 {
+		return interval, true
+	}
+
+	lastHit := hits.List[len(hits.List)-1]
+	if hint := lastHit.EnqueueHint; hint != nil && hint.Stop {
+		return 0, false
+	}
+
+	if lastHit.HasEnqueue {
+		if lastHit.Enqueue < 0 {
+			return 0, true
+		}
+
+		return time.Duration(lastHit.Enqueue) * time.Second, true
+	}
+
+	if hits.StopReason.HasMore() {
+		return 0, true
+	}
+
+	return interval, true
+}
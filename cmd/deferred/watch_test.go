@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daohoangson/go-deferred/pkg/clock"
+	"github.com/daohoangson/go-deferred/pkg/runner"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetNextDelay(t *testing.T) {
+	interval := time.Minute
+	noMore := runner.Hits{List: []runner.Hit{runner.Hit{}}, StopReason: runner.StopReasonNoMore}
+	maxHits := runner.Hits{List: []runner.Hit{runner.Hit{}}, StopReason: runner.StopReasonMaxHits}
+	enqueue := runner.Hits{List: []runner.Hit{runner.Hit{Enqueue: 30, HasEnqueue: true}}, StopReason: runner.StopReasonNoMore}
+	negative := runner.Hits{List: []runner.Hit{runner.Hit{Enqueue: -1, HasEnqueue: true}}, StopReason: runner.StopReasonNoMore}
+
+	stop := runner.Hits{List: []runner.Hit{runner.Hit{EnqueueHint: &runner.EnqueueHint{Stop: true}}}, StopReason: runner.StopReasonNoMore}
+
+	for _, c := range []struct {
+		hits     runner.Hits
+		err      error
+		expected time.Duration
+	}{
+		{noMore, nil, interval},
+		{maxHits, nil, 0},
+		{enqueue, nil, 30 * time.Second},
+		{negative, nil, 0},
+		{enqueue, errors.New("error"), interval},
+	} {
+		delay, ok := getNextDelay(c.hits, c.err, interval)
+		assert.True(t, ok)
+		assert.Equal(t, c.expected, delay)
+	}
+
+	_, ok := getNextDelay(stop, nil, interval)
+	assert.False(t, ok)
+}
+
+func TestRunWatch(t *testing.T) {
+	urls := []string{"http://a.com/hinted", "http://b.com/interval", "http://c.com/never"}
+
+	var mutex sync.Mutex
+	counts := make(map[string]int)
+	slowStarted := make(chan struct{})
+	loop := func(u string) (runner.Hits, error) {
+		mutex.Lock()
+		counts[u]++
+		mutex.Unlock()
+
+		switch u {
+		case urls[0]:
+			return runner.Hits{List: []runner.Hit{runner.Hit{HasEnqueue: true}}}, nil
+		case urls[1]:
+			return runner.Hits{List: []runner.Hit{runner.Hit{}}}, nil
+		}
+
+		// outlasts the watch
+		close(slowStarted)
+		time.Sleep(50 * time.Millisecond)
+		return runner.Hits{}, errors.New("slow")
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		<-slowStarted
+		time.Sleep(30 * time.Millisecond)
+		close(stop)
+	}()
+
+	results := runWatch(urls, 0, false, time.Hour, clock.New(), stop, loop)
+
+	assert.Equal(t, len(urls), len(results))
+	for i, result := range results {
+		assert.Equal(t, urls[i], result.URL)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.True(t, counts[urls[0]] > 1)
+	assert.Equal(t, 1, counts[urls[1]])
+	assert.Equal(t, 1, counts[urls[2]])
+
+	// running loops are waited for
+	assert.NotNil(t, results[2].Error)
+}
+
+func TestRunWatchSerializeHosts(t *testing.T) {
+	urls := []string{"http://a.com/1", "http://a.com/2", "http://b.com/1", "http://a.com/3"}
+
+	var mutex sync.Mutex
+	running := make(map[string]int)
+	maxRunning := make(map[string]int)
+	finished := make(map[string]int)
+	finishedAtB := -1
+	loop := func(u string) (runner.Hits, error) {
+		host := getHost(u)
+		mutex.Lock()
+		running[host]++
+		if running[host] > maxRunning[host] {
+			maxRunning[host] = running[host]
+		}
+		if host == "b.com" {
+			finishedAtB = finished["a.com"]
+		}
+		mutex.Unlock()
+
+		if host == "a.com" {
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		mutex.Lock()
+		running[host]--
+		finished[host]++
+		mutex.Unlock()
+		return runner.Hits{List: []runner.Hit{runner.Hit{EnqueueHint: &runner.EnqueueHint{Stop: true}}}}, nil
+	}
+
+	results := runWatch(urls, 2, true, time.Hour, clock.New(), make(chan struct{}), loop)
+	assert.Equal(t, len(urls), len(results))
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, 1, maxRunning["a.com"])
+	assert.Equal(t, 3, finished["a.com"])
+
+	// URLs waiting for a.com do not hold the second slot
+	assert.Equal(t, 0, finishedAtB)
+}
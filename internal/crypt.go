@@ -2,6 +2,7 @@ package internal // import "github.com/daohoangson/go-deferred/internal"
 
 import (
 	"crypto/md5"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
 )
@@ -17,3 +18,10 @@ func GetMD5(data string, secret string) string {
 	hasher.Write([]byte(data + secret))
 	return hex.EncodeToString(hasher.Sum(nil))
 }
+
+// NewRequestID returns a random id to correlate log entries
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
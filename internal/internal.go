@@ -1,8 +1,71 @@
 package internal // import "github.com/daohoangson/go-deferred/internal"
 
+import "strconv"
+
+// ProtocolFeature represents an addition to go-deferred protocol,
+// it is only used with targets that advertise a version having it
+type ProtocolFeature string
+
+const (
+	// ProtocolFeatureProgress lets targets report their pending jobs
+	ProtocolFeatureProgress ProtocolFeature = "progress"
+	// ProtocolFeatureStructuredEnqueue lets targets send enqueue hints with more than a delay
+	ProtocolFeatureStructuredEnqueue ProtocolFeature = "structured_enqueue"
+)
+
 // GetProtocolVersion returns the version string for go-deferred protocol
 func GetProtocolVersion() string {
-	return "2018061901"
+	return "2026101901"
+}
+
+// GetProtocolFeatureVersion returns the first protocol version having the feature
+func GetProtocolFeatureVersion(feature ProtocolFeature) string {
+	switch feature {
+	case ProtocolFeatureProgress, ProtocolFeatureStructuredEnqueue:
+		return "2026101901"
+	}
+
+	// unknown features are never negotiated
+	return "9999999999"
+}
+
+// HasProtocolFeature returns true if the negotiated version has the feature
+func HasProtocolFeature(version string, feature ProtocolFeature) bool {
+	return compareProtocolVersions(version, GetProtocolFeatureVersion(feature)) >= 0
+}
+
+// NegotiateProtocolVersion returns the lower of our version and the one advertised by a target,
+// it returns empty string if the advertised version is empty or invalid
+func NegotiateProtocolVersion(advertised string) string {
+	if _, err := strconv.ParseUint(advertised, 10, 64); err != nil {
+		return ""
+	}
+
+	if compareProtocolVersions(advertised, GetProtocolVersion()) < 0 {
+		return advertised
+	}
+
+	return GetProtocolVersion()
+}
+
+// compareProtocolVersions returns -1, 0 or 1, an invalid version is lower than any valid one
+func compareProtocolVersions(a string, b string) int {
+	aValue, aErr := strconv.ParseUint(a, 10, 64)
+	bValue, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr != nil && bErr != nil:
+		return 0
+	case aErr != nil:
+		return -1
+	case bErr != nil:
+		return 1
+	case aValue < bValue:
+		return -1
+	case aValue > bValue:
+		return 1
+	}
+
+	return 0
 }
 
 // GetProtocolVersionHeaderKey returns the header key for go-deferred protocol version
@@ -15,6 +78,11 @@ func GetProtocolEnqueueHeaderKey() string {
 	return "X-Go-Deferred-Enqueue"
 }
 
+// GetRequestIDHeaderKey returns the header key for request id
+func GetRequestIDHeaderKey() string {
+	return "X-Request-Id"
+}
+
 // Ternary returns trueValue if condition is true and falseValue otherwise
 // https://stackoverflow.com/questions/19979178/what-is-the-idiomatic-go-equivalent-of-cs-ternary-operator
 func Ternary(condition bool, trueValue interface{}, falseValue interface{}) interface{} {
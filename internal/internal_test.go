@@ -0,0 +1,22 @@
+package internal // import "github.com/daohoangson/go-deferred/internal"
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	assert.Equal(t, "", NegotiateProtocolVersion(""))
+	assert.Equal(t, "", NegotiateProtocolVersion("v2"))
+	assert.Equal(t, "2018061901", NegotiateProtocolVersion("2018061901"))
+	assert.Equal(t, GetProtocolVersion(), NegotiateProtocolVersion("9999999999"))
+}
+
+func TestHasProtocolFeature(t *testing.T) {
+	assert.False(t, HasProtocolFeature("", ProtocolFeatureProgress))
+	assert.False(t, HasProtocolFeature("2018061901", ProtocolFeatureProgress))
+	assert.True(t, HasProtocolFeature(GetProtocolVersion(), ProtocolFeatureProgress))
+	assert.True(t, HasProtocolFeature(GetProtocolVersion(), ProtocolFeatureStructuredEnqueue))
+	assert.False(t, HasProtocolFeature(GetProtocolVersion(), ProtocolFeature("unknown")))
+}
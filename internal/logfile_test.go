@@ -0,0 +1,34 @@
+package internal // import "github.com/daohoangson/go-deferred/internal"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfile")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deferred.log")
+
+	f, err := NewRotatingFile(path, 10, 2)
+	assert.Nil(t, err)
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := f.Write([]byte(line))
+		assert.Nil(t, err)
+	}
+
+	current, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "fourth\n", string(current))
+	backup1, _ := ioutil.ReadFile(path + ".1")
+	assert.Equal(t, "third\n", string(backup1))
+	backup2, _ := ioutil.ReadFile(path + ".2")
+	assert.Equal(t, "second\n", string(backup2))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
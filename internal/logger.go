@@ -1,26 +1,121 @@
 package internal // import "github.com/daohoangson/go-deferred/internal"
 
 import (
+	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 )
 
-var _logger *logrus.Logger
+// Log components, each may have its own level via DEFERRED_LOG_LEVEL_<COMPONENT>
+const (
+	LogComponentAlert     = "alert"
+	LogComponentHTTP      = "http"
+	LogComponentRunner    = "runner"
+	LogComponentScheduler = "scheduler"
+)
+
+// Log field names, these are documented and should be kept stable
+const (
+	LogFieldComponent = "component"
+	LogFieldRequestID = "request_id"
+	LogFieldStep      = "step"
+	LogFieldTarget    = "target"
+)
+
+var _loggers = make(map[string]*logrus.Logger)
+var _loggersMutex sync.Mutex
+var _logFormatter logrus.Formatter
+var _logOutput io.Writer
+
+type componentHook struct {
+	component string
+}
 
 // GetLogger prepares a default logger instance
 func GetLogger() *logrus.Logger {
-	if _logger == nil {
-		_logger = logrus.New()
-
-		levelValue := os.Getenv("DEFERRED_LOG_LEVEL")
-		if len(levelValue) > 0 {
-			if level, err := logrus.ParseLevel(levelValue); err == nil {
-				_logger.SetLevel(level)
-				_logger.WithField("level", level).Info("Updated logger level")
-			}
+	return GetComponentLogger("")
+}
+
+// GetComponentLogger prepares a logger instance for the specified component
+func GetComponentLogger(component string) *logrus.Logger {
+	_loggersMutex.Lock()
+	defer _loggersMutex.Unlock()
+
+	if logger, ok := _loggers[component]; ok {
+		return logger
+	}
+
+	prepareLogOutput()
+
+	logger := logrus.New()
+	logger.Formatter = _logFormatter
+	logger.Out = _logOutput
+
+	levelValue := os.Getenv("DEFERRED_LOG_LEVEL")
+	if len(component) > 0 {
+		logger.AddHook(&componentHook{component})
+
+		componentLevelValue := os.Getenv("DEFERRED_LOG_LEVEL_" + strings.ToUpper(component))
+		if len(componentLevelValue) > 0 {
+			levelValue = componentLevelValue
+		}
+	}
+	if len(levelValue) > 0 {
+		if level, err := logrus.ParseLevel(levelValue); err == nil {
+			logger.SetLevel(level)
+			logger.WithField("level", level).Info("Updated logger level")
 		}
 	}
 
-	return _logger
+	_loggers[component] = logger
+	return logger
+}
+
+func (h *componentHook) Fire(entry *logrus.Entry) error {
+	entry.Data[LogFieldComponent] = h.component
+	return nil
+}
+
+func (h *componentHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func prepareLogOutput() {
+	if _logFormatter != nil {
+		return
+	}
+
+	_logFormatter = &logrus.TextFormatter{}
+	if os.Getenv("DEFERRED_LOG_FORMAT") == "json" {
+		_logFormatter = &logrus.JSONFormatter{}
+	}
+
+	_logOutput = os.Stderr
+	fileValue := os.Getenv("DEFERRED_LOG_FILE")
+	if len(fileValue) > 0 {
+		maxSize := int64(10 * 1024 * 1024)
+		if maxSizeValue := os.Getenv("DEFERRED_LOG_FILE_MAX_SIZE"); len(maxSizeValue) > 0 {
+			if maxSizeParsed, err := strconv.ParseInt(maxSizeValue, 10, 64); err == nil {
+				maxSize = maxSizeParsed
+			}
+		}
+
+		maxBackups := 3
+		if maxBackupsValue := os.Getenv("DEFERRED_LOG_FILE_MAX_BACKUPS"); len(maxBackupsValue) > 0 {
+			if maxBackupsParsed, err := strconv.Atoi(maxBackupsValue); err == nil {
+				maxBackups = maxBackupsParsed
+			}
+		}
+
+		if file, err := NewRotatingFile(fileValue, maxSize, maxBackups); err == nil {
+			_logOutput = file
+		} else {
+			fmt.Fprintf(os.Stderr, "Could not open log file %s (%s)\n", fileValue, err)
+		}
+	}
 }
@@ -0,0 +1,181 @@
+package alert // import "github.com/daohoangson/go-deferred/pkg/alert"
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/daohoangson/go-deferred/internal"
+	"github.com/daohoangson/go-deferred/pkg/clock"
+)
+
+// queueSize limits the alerts waiting to be sent, others are dropped
+const queueSize = 100
+
+type alerter struct {
+	clock  clock.Clock
+	logger *logrus.Logger
+
+	dedupWindow time.Duration
+	rateLimit   int
+	rateWindow  time.Duration
+
+	mutex   sync.Mutex
+	dropped uint64
+	sent    map[string]time.Time
+	recent  []time.Time
+	sinks   []Sink
+
+	pending sync.WaitGroup
+	queue   chan Event
+}
+
+// New returns an Alerter instance configured from env vars, clock may be nil to use real time
+func New(c clock.Clock, logger *logrus.Logger) Alerter {
+	a := &alerter{}
+	a.init(c, logger)
+	return a
+}
+
+func (a *alerter) AddSink(sink Sink) {
+	a.mutex.Lock()
+	a.sinks = append(a.sinks, sink)
+	a.mutex.Unlock()
+}
+
+func (a *alerter) Notify(e Event) {
+	logger := a.logger.WithFields(logrus.Fields{
+		"kind":                  e.Kind,
+		internal.LogFieldTarget: e.Target,
+	})
+
+	a.mutex.Lock()
+	sinks := a.sinks
+	if len(sinks) == 0 {
+		a.mutex.Unlock()
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = a.clock.Now()
+	}
+
+	key := string(e.Kind) + " " + e.Target
+	if sentAt, ok := a.sent[key]; ok && e.Time.Sub(sentAt) < a.dedupWindow {
+		a.mutex.Unlock()
+		logger.Debug("Deduplicated alert")
+		return
+	}
+
+	recent := a.recent[:0]
+	for _, t := range a.recent {
+		if e.Time.Sub(t) < a.rateWindow {
+			recent = append(recent, t)
+		}
+	}
+	a.recent = recent
+	if a.rateLimit > 0 && len(a.recent) >= a.rateLimit {
+		a.dropped++
+		dropped := a.dropped
+		a.mutex.Unlock()
+		logger.WithField("dropped", dropped).Warn("Rate limited alert")
+		return
+	}
+
+	// sinks may be slow, they must not block the caller
+	a.pending.Add(1)
+	select {
+	case a.queue <- e:
+	default:
+		a.pending.Done()
+		a.dropped++
+		dropped := a.dropped
+		a.mutex.Unlock()
+		logger.WithField("dropped", dropped).Warn("Could not queue alert")
+		return
+	}
+
+	a.sent[key] = e.Time
+	a.recent = append(a.recent, e.Time)
+	a.mutex.Unlock()
+}
+
+func (a *alerter) send(e Event) {
+	logger := a.logger.WithFields(logrus.Fields{
+		"kind":                  e.Kind,
+		internal.LogFieldTarget: e.Target,
+	})
+
+	a.mutex.Lock()
+	sinks := a.sinks
+	a.mutex.Unlock()
+
+	for _, sink := range sinks {
+		if err := sink.Send(e); err != nil {
+			logger.WithError(err).Error("Could not send alert")
+		}
+	}
+
+	logger.Info("Sent alert")
+}
+
+func (a *alerter) init(c clock.Clock, logger *logrus.Logger) {
+	if c == nil {
+		c = clock.New()
+	}
+	a.clock = c
+
+	if logger == nil {
+		logger = internal.GetComponentLogger(internal.LogComponentAlert)
+	}
+	a.logger = logger
+
+	a.sent = make(map[string]time.Time)
+
+	a.queue = make(chan Event, queueSize)
+	go func() {
+		for e := range a.queue {
+			a.send(e)
+			a.pending.Done()
+		}
+	}()
+
+	a.dedupWindow = time.Hour
+	dedupWindowValue := os.Getenv("DEFERRED_ALERT_DEDUP_WINDOW")
+	if len(dedupWindowValue) > 0 {
+		if dedupWindow, err := time.ParseDuration(dedupWindowValue); err == nil {
+			a.dedupWindow = dedupWindow
+			logger.WithField("value", dedupWindow).Info("Updated alert dedup window")
+		}
+	}
+
+	a.rateLimit = 10
+	a.rateWindow = time.Minute
+	rateLimitValue := os.Getenv("DEFERRED_ALERT_RATE_LIMIT")
+	if len(rateLimitValue) > 0 {
+		if rateLimit, err := strconv.Atoi(rateLimitValue); err == nil {
+			a.rateLimit = rateLimit
+			logger.WithField("value", rateLimit).Info("Updated alert rate limit")
+		}
+	}
+
+	webhookValue := os.Getenv("DEFERRED_ALERT_WEBHOOK")
+	if len(webhookValue) > 0 {
+		a.sinks = append(a.sinks, NewWebhook(webhookValue, nil))
+		logger.WithField("value", webhookValue).Info("Updated alert webhook")
+	}
+
+	slackValue := os.Getenv("DEFERRED_ALERT_SLACK")
+	if len(slackValue) > 0 {
+		a.sinks = append(a.sinks, NewSlack(slackValue, nil))
+		logger.Info("Updated alert Slack webhook")
+	}
+
+	execValue := os.Getenv("DEFERRED_ALERT_EXEC")
+	if len(execValue) > 0 {
+		a.sinks = append(a.sinks, NewExec(execValue))
+		logger.WithField("value", execValue).Info("Updated alert exec hook")
+	}
+}
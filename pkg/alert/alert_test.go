@@ -0,0 +1,153 @@
+package alert // import "github.com/daohoangson/go-deferred/pkg/alert"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/daohoangson/go-deferred/pkg/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+type recorder struct {
+	events []Event
+}
+
+func (r *recorder) Send(e Event) error {
+	r.events = append(r.events, e)
+	return nil
+}
+
+func TestDedup(t *testing.T) {
+	c := clock.NewTestFake()
+	a, r := testInit(c)
+
+	a.Notify(Event{Kind: KindFirstFailure, Target: "a"})
+	a.Notify(Event{Kind: KindFirstFailure, Target: "a"})
+	a.Notify(Event{Kind: KindFirstFailure, Target: "b"})
+	a.Notify(Event{Kind: KindRecovery, Target: "a"})
+	a.pending.Wait()
+	assert.Equal(t, 3, len(r.events))
+
+	c.Advance(a.dedupWindow)
+	a.Notify(Event{Kind: KindFirstFailure, Target: "a"})
+	a.pending.Wait()
+	assert.Equal(t, 4, len(r.events))
+	assert.Equal(t, c.Now(), r.events[3].Time)
+}
+
+func TestRateLimit(t *testing.T) {
+	c := clock.NewTestFake()
+	a, r := testInit(c)
+	a.rateLimit = 2
+
+	a.Notify(Event{Kind: KindFirstFailure, Target: "a"})
+	a.Notify(Event{Kind: KindFirstFailure, Target: "b"})
+	a.Notify(Event{Kind: KindFirstFailure, Target: "c"})
+	a.pending.Wait()
+	assert.Equal(t, 2, len(r.events))
+	assert.Equal(t, uint64(1), a.dropped)
+
+	c.Advance(a.rateWindow)
+	a.Notify(Event{Kind: KindFirstFailure, Target: "c"})
+	a.pending.Wait()
+	assert.Equal(t, 3, len(r.events))
+}
+
+func TestSlowSink(t *testing.T) {
+	c := clock.NewTestFake()
+	a, _ := testInit(c)
+	a.rateLimit = 0
+
+	blocked := make(chan struct{})
+	a.sinks = []Sink{blockingSink(blocked)}
+	for i := 0; i < queueSize+2; i++ {
+		// the first event is being sent, the queue is then filled up
+		a.Notify(Event{Kind: KindFirstFailure, Target: fmt.Sprintf("%d", i)})
+	}
+	assert.True(t, a.dropped > 0)
+
+	close(blocked)
+	a.pending.Wait()
+}
+
+func TestWebhook(t *testing.T) {
+	var bodies []map[string]interface{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := make(map[string]interface{})
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+	}))
+	defer s.Close()
+
+	e := Event{Kind: KindCircuitOpen, Message: "Timeout", Target: "a"}
+	assert.Nil(t, NewWebhook(s.URL, nil).Send(e))
+	assert.Nil(t, NewSlack(s.URL, nil).Send(e))
+
+	assert.Equal(t, 2, len(bodies))
+	assert.Equal(t, "circuit_open", bodies[0]["kind"])
+	assert.Equal(t, "a", bodies[0]["target"])
+	assert.Equal(t, "[circuit_open] a: Timeout", bodies[1]["text"])
+}
+
+func TestWebhookStatus(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer s.Close()
+
+	assert.NotNil(t, NewWebhook(s.URL, nil).Send(Event{}))
+}
+
+func TestExec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alert")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "alert.json")
+
+	script := filepath.Join(dir, "alert.sh")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\ncat > \"$1\"\necho \"$DEFERRED_ALERT_KIND\" >> \"$1.kind\"\n"), 0755)
+
+	e := Event{Kind: KindRecovery, Target: "a"}
+	assert.Nil(t, NewExec(script+" "+path).Send(e))
+
+	data, _ := ioutil.ReadFile(path)
+	sent := Event{}
+	assert.Nil(t, json.Unmarshal(data, &sent))
+	assert.Equal(t, e.Target, sent.Target)
+
+	kind, _ := ioutil.ReadFile(path + ".kind")
+	assert.Equal(t, "recovery\n", string(kind))
+
+	assert.NotNil(t, NewExec(filepath.Join(dir, "missing")).Send(e))
+
+	timeStart := time.Now()
+	hook := NewExec("sleep 10").(*execHook)
+	hook.timeout = 100 * time.Millisecond
+	assert.NotNil(t, hook.Send(e))
+	assert.True(t, time.Since(timeStart) < 5*time.Second)
+}
+
+type blockingSink chan struct{}
+
+func (s blockingSink) Send(e Event) error {
+	<-s
+	return nil
+}
+
+func testInit(c clock.Clock) (*alerter, *recorder) {
+	a := &alerter{}
+	a.init(c, nil)
+
+	r := &recorder{}
+	a.sinks = nil
+	a.AddSink(r)
+
+	return a, r
+}
@@ -0,0 +1,42 @@
+package alert // import "github.com/daohoangson/go-deferred/pkg/alert"
+import "time"
+
+// Alerter represents a dispatcher that deduplicates and rate limits events before sending them to sinks
+type Alerter interface {
+	AddSink(Sink)
+	Notify(Event)
+}
+
+// Sink represents a destination for alerts
+type Sink interface {
+	Send(Event) error
+}
+
+// Event represents a state transition of a target
+type Event struct {
+	Kind    Kind      `json:"kind"`
+	Message string    `json:"message"`
+	Target  string    `json:"target"`
+	Time    time.Time `json:"time"`
+
+	ConsecutiveErrors uint64    `json:"consecutive_errors"`
+	LastHit           time.Time `json:"last_hit"`
+}
+
+// Kind represents the transition that triggered an event
+type Kind string
+
+// Kinds of events
+const (
+	// KindFirstFailure is sent when a loop fails after a successful one
+	KindFirstFailure Kind = "first_failure"
+
+	// KindCircuitOpen is sent when consecutive failed loops reach the threshold, the target is considered down
+	KindCircuitOpen Kind = "circuit_open"
+
+	// KindRecovery is sent when a loop succeeds after failed ones
+	KindRecovery Kind = "recovery"
+
+	// KindNoSuccess is sent when the last successful hit of a failing target is too old
+	KindNoSuccess Kind = "no_success"
+)
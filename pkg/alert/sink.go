@@ -0,0 +1,110 @@
+package alert // import "github.com/daohoangson/go-deferred/pkg/alert"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+type webhook struct {
+	client *http.Client
+	url    string
+	format func(Event) interface{}
+}
+
+type execHook struct {
+	args    []string
+	timeout time.Duration
+}
+
+// NewWebhook returns a Sink that posts events as JSON, client may be nil to use a default one
+func NewWebhook(url string, client *http.Client) Sink {
+	return newWebhook(url, client, func(e Event) interface{} { return e })
+}
+
+// NewSlack returns a Sink that posts events to a Slack-compatible incoming webhook
+func NewSlack(url string, client *http.Client) Sink {
+	return newWebhook(url, client, func(e Event) interface{} {
+		return map[string]string{"text": FormatText(e)}
+	})
+}
+
+// NewExec returns a Sink that runs a local command for each event,
+// the event is available as JSON via stdin and as DEFERRED_ALERT_* env vars
+func NewExec(command string) Sink {
+	return &execHook{args: strings.Fields(command), timeout: 10 * time.Second}
+}
+
+// FormatText returns a human readable line for an event
+func FormatText(e Event) string {
+	text := fmt.Sprintf("[%s] %s", e.Kind, e.Target)
+	if len(e.Message) > 0 {
+		text += ": " + e.Message
+	}
+
+	return text
+}
+
+func newWebhook(url string, client *http.Client, format func(Event) interface{}) *webhook {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &webhook{client: client, url: url, format: format}
+}
+
+func (w *webhook) Send(e Event) error {
+	body, err := json.Marshal(w.format(e))
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (h *execHook) Send(e Event) error {
+	if len(h.args) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.args[0], h.args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"DEFERRED_ALERT_KIND="+string(e.Kind),
+		"DEFERRED_ALERT_MESSAGE="+e.Message,
+		"DEFERRED_ALERT_TARGET="+e.Target,
+	)
+	cmd.Stdin = bytes.NewReader(body)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, bytes.TrimSpace(output))
+	}
+
+	return nil
+}
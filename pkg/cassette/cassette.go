@@ -0,0 +1,183 @@
+package cassette // import "github.com/daohoangson/go-deferred/pkg/cassette"
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type recorder struct {
+	next http.RoundTripper
+
+	file      *os.File
+	fileMutex sync.Mutex
+}
+
+type replayer struct {
+	interactions      map[string][]Interaction
+	interactionsMutex sync.Mutex
+	realTime          bool
+}
+
+// Load reads all interactions from a cassette file
+func Load(path string) ([]Interaction, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var interactions []Interaction
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var interaction Interaction
+		if err := json.Unmarshal(line, &interaction); err != nil {
+			return nil, err
+		}
+		interactions = append(interactions, interaction)
+	}
+
+	return interactions, scanner.Err()
+}
+
+// NewRecorder returns a RoundTripper that appends every interaction of next to the cassette file
+func NewRecorder(path string, next http.RoundTripper) (http.RoundTripper, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	r := &recorder{}
+	r.file = file
+	r.next = next
+	return r, nil
+}
+
+// NewReplayer returns a RoundTripper that serves recorded interactions in order for each method and URL,
+// set realTime to wait for the recorded elapsed time before responding
+func NewReplayer(path string, realTime bool) (http.RoundTripper, error) {
+	interactions, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &replayer{}
+	r.interactions = make(map[string][]Interaction)
+	r.realTime = realTime
+	for _, interaction := range interactions {
+		key := getKey(interaction.Request.Method, interaction.Request.URL)
+		r.interactions[key] = append(r.interactions[key], interaction)
+	}
+
+	return r, nil
+}
+
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	interaction := Interaction{}
+	interaction.TimeStart = time.Now()
+	interaction.Request.Method = req.Method
+	interaction.Request.URL = req.URL.String()
+	interaction.Request.Header = req.Header
+
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		interaction.Request.Body = string(body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	resp, err := r.next.RoundTrip(req)
+	if err == nil {
+		var body []byte
+		body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		interaction.Response = &Response{
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			Body:       string(body),
+		}
+	}
+	interaction.TimeElapsed = time.Since(interaction.TimeStart)
+	if err != nil {
+		interaction.Error = err.Error()
+	}
+
+	if writeErr := r.write(interaction); writeErr != nil {
+		fmt.Fprintf(os.Stderr, "Could not record interaction: %s\n", writeErr)
+	}
+
+	return resp, err
+}
+
+func (r *recorder) write(interaction Interaction) error {
+	line, err := json.Marshal(interaction)
+	if err != nil {
+		return err
+	}
+
+	r.fileMutex.Lock()
+	defer r.fileMutex.Unlock()
+
+	_, err = r.file.Write(append(line, '\n'))
+	return err
+}
+
+func (r *replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := getKey(req.Method, req.URL.String())
+
+	r.interactionsMutex.Lock()
+	interactions := r.interactions[key]
+	if len(interactions) == 0 {
+		r.interactionsMutex.Unlock()
+		return nil, fmt.Errorf("No recorded interaction for %s", key)
+	}
+	interaction := interactions[0]
+	r.interactions[key] = interactions[1:]
+	r.interactionsMutex.Unlock()
+
+	if r.realTime && interaction.TimeElapsed > 0 {
+		time.Sleep(interaction.TimeElapsed)
+	}
+
+	if interaction.Response == nil {
+		return nil, fmt.Errorf("Recorded error: %s", interaction.Error)
+	}
+
+	body := []byte(interaction.Response.Body)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", interaction.Response.StatusCode, http.StatusText(interaction.Response.StatusCode)),
+		StatusCode:    interaction.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        interaction.Response.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+func getKey(method, url string) string {
+	return method + " " + url
+}
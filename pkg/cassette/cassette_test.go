@@ -0,0 +1,94 @@
+package cassette // import "github.com/daohoangson/go-deferred/pkg/cassette"
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	path, cleanUp := testPath(t)
+	defer cleanUp()
+
+	counter := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Header().Set("X-Counter", fmt.Sprintf("%d", counter))
+		w.WriteHeader(http.StatusTeapot)
+		fmt.Fprintf(w, "body %d", counter)
+	}))
+	url := s.URL
+
+	recorder, err := NewRecorder(path, nil)
+	assert.Nil(t, err)
+	recordedBodies := testPost(t, &http.Client{Transport: recorder}, url, 2)
+	s.Close()
+
+	interactions, err := Load(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(interactions))
+	assert.Equal(t, "POST", interactions[0].Request.Method)
+	assert.Equal(t, url, interactions[0].Request.URL)
+	assert.Equal(t, "request", interactions[0].Request.Body)
+	assert.Equal(t, http.StatusTeapot, interactions[0].Response.StatusCode)
+	assert.Equal(t, "2", interactions[1].Response.Header.Get("X-Counter"))
+
+	replayer, err := NewReplayer(path, false)
+	assert.Nil(t, err)
+	client := &http.Client{Transport: replayer}
+	replayedBodies := testPost(t, client, url, 2)
+	assert.Equal(t, recordedBodies, replayedBodies)
+
+	_, exhaustedErr := client.Post(url, "text/plain", nil)
+	assert.NotNil(t, exhaustedErr)
+}
+
+func TestRecordError(t *testing.T) {
+	path, cleanUp := testPath(t)
+	defer cleanUp()
+
+	s := httptest.NewServer(http.NotFoundHandler())
+	url := s.URL
+	s.Close()
+
+	recorder, err := NewRecorder(path, nil)
+	assert.Nil(t, err)
+	_, recordedErr := (&http.Client{Transport: recorder}).Post(url, "text/plain", nil)
+	assert.NotNil(t, recordedErr)
+
+	replayer, err := NewReplayer(path, false)
+	assert.Nil(t, err)
+	_, replayedErr := (&http.Client{Transport: replayer}).Post(url, "text/plain", nil)
+	assert.NotNil(t, replayedErr)
+}
+
+func testPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "cassette")
+	assert.Nil(t, err)
+
+	return filepath.Join(dir, "cassette.jsonl"), func() { os.RemoveAll(dir) }
+}
+
+func testPost(t *testing.T, client *http.Client, url string, count int) []string {
+	var bodies []string
+
+	for i := 0; i < count; i++ {
+		resp, err := client.Post(url, "text/plain", strings.NewReader("request"))
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusTeapot, resp.StatusCode)
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Nil(t, err)
+		bodies = append(bodies, string(body))
+	}
+
+	return bodies
+}
@@ -0,0 +1,30 @@
+package cassette // import "github.com/daohoangson/go-deferred/pkg/cassette"
+
+import (
+	"net/http"
+	"time"
+)
+
+// Interaction represents a recorded request/response pair, one per line in a cassette file
+type Interaction struct {
+	Request     Request       `json:"request"`
+	Response    *Response     `json:"response,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	TimeStart   time.Time     `json:"time_start"`
+	TimeElapsed time.Duration `json:"time_elapsed"`
+}
+
+// Request represents a recorded http request
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body,omitempty"`
+}
+
+// Response represents a recorded http response
+type Response struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body"`
+}
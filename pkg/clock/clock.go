@@ -0,0 +1,22 @@
+package clock // import "github.com/daohoangson/go-deferred/pkg/clock"
+
+import "time"
+
+type realClock struct{}
+
+// New returns a Clock backed by the time package
+func New() Clock {
+	return realClock{}
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
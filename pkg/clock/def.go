@@ -0,0 +1,9 @@
+package clock // import "github.com/daohoangson/go-deferred/pkg/clock"
+import "time"
+
+// Clock represents a source of time that can be replaced in tests
+type Clock interface {
+	After(d time.Duration) <-chan time.Time
+	Now() time.Time
+	Sleep(d time.Duration)
+}
@@ -0,0 +1,135 @@
+package clock // import "github.com/daohoangson/go-deferred/pkg/clock"
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake represents a Clock that only moves when told to
+type Fake struct {
+	mutex       sync.Mutex
+	autoAdvance bool
+	now         time.Time
+	sleepers    int
+	waiters     []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	c       chan time.Time
+	sleeper bool
+	until   time.Time
+}
+
+// NewFake returns a Fake clock starting at the specified time
+func NewFake(now time.Time) *Fake {
+	f := &Fake{}
+	f.now = now
+	return f
+}
+
+// NewTestFake returns a Fake clock starting at the same time for every test
+func NewTestFake() *Fake {
+	return NewFake(time.Date(2018, time.June, 19, 0, 0, 0, 0, time.UTC))
+}
+
+// Advance moves the clock forward and fires all waiters that are due
+func (f *Fake) Advance(d time.Duration) {
+	f.mutex.Lock()
+	f.now = f.now.Add(d)
+	now := f.now
+
+	waiters := f.waiters[:0]
+	for _, w := range f.waiters {
+		if w.until.After(now) {
+			waiters = append(waiters, w)
+			continue
+		}
+
+		if w.sleeper {
+			f.sleepers--
+		}
+		w.c <- now
+	}
+	f.waiters = waiters
+	f.mutex.Unlock()
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.wait(d, false)
+}
+
+// Next returns the time of the earliest waiter, if any
+func (f *Fake) Next() (time.Time, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var next time.Time
+	for _, w := range f.waiters {
+		if next.IsZero() || w.until.Before(next) {
+			next = w.until
+		}
+	}
+
+	return next, !next.IsZero()
+}
+
+func (f *Fake) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.now
+}
+
+// SetAutoAdvance makes Sleep move the clock forward instead of blocking,
+// useful when there is only one goroutine using the clock
+func (f *Fake) SetAutoAdvance(autoAdvance bool) {
+	f.mutex.Lock()
+	f.autoAdvance = autoAdvance
+	f.mutex.Unlock()
+}
+
+func (f *Fake) Sleep(d time.Duration) {
+	f.mutex.Lock()
+	autoAdvance := f.autoAdvance
+	f.mutex.Unlock()
+
+	if autoAdvance {
+		if d > 0 {
+			f.Advance(d)
+		}
+		return
+	}
+
+	<-f.wait(d, true)
+}
+
+// Sleepers returns the number of goroutines currently blocked in Sleep
+func (f *Fake) Sleepers() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.sleepers
+}
+
+func (f *Fake) wait(d time.Duration, sleeper bool) <-chan time.Time {
+	c := make(chan time.Time, 1)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if d <= 0 {
+		c <- f.now
+		return c
+	}
+
+	f.waiters = append(f.waiters, &fakeWaiter{
+		c:       c,
+		sleeper: sleeper,
+		until:   f.now.Add(d),
+	})
+	if sleeper {
+		f.sleepers++
+	}
+
+	return c
+}
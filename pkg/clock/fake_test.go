@@ -0,0 +1,45 @@
+package clock // import "github.com/daohoangson/go-deferred/pkg/clock"
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeAfter(t *testing.T) {
+	f := NewTestFake()
+	start := f.Now()
+	c := f.After(time.Second)
+
+	next, ok := f.Next()
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(time.Second), next)
+
+	f.Advance(time.Second / 2)
+	assert.Equal(t, 0, len(c))
+
+	f.Advance(time.Second / 2)
+	assert.Equal(t, start.Add(time.Second), <-c)
+
+	_, ok = f.Next()
+	assert.False(t, ok)
+}
+
+func TestFakeSleep(t *testing.T) {
+	f := NewTestFake()
+	done := make(chan bool)
+
+	go func() {
+		f.Sleep(time.Second)
+		done <- true
+	}()
+
+	for f.Sleepers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	f.Advance(time.Second)
+	assert.True(t, <-done)
+	assert.Equal(t, 0, f.Sleepers())
+}
@@ -0,0 +1,114 @@
+package daemon // import "github.com/daohoangson/go-deferred/pkg/daemon"
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/daohoangson/go-deferred/internal"
+)
+
+// readEndpoints may be made private, /queue has its own hash
+var readEndpoints = []string{"/debug/scheduler", "/healthz", "/metrics", "/queued", "/readyz", "/stats"}
+
+// readAccess tells which targets a caller of the read endpoints may see
+type readAccess struct {
+	// full is set for a valid token or basic auth, or when read auth is not configured
+	full bool
+
+	// target is set for a query signed the same way as /queue, only that target is shown
+	target string
+
+	secret string
+}
+
+func (a readAccess) isAuthenticated() bool {
+	return a.full || len(a.target) > 0
+}
+
+// name returns how the target is shown to the caller, false if it should be left out
+func (a readAccess) name(target string) (string, bool) {
+	if a.full {
+		return target, true
+	}
+
+	if len(a.target) > 0 {
+		return target, target == a.target
+	}
+
+	// the redacted name is stable so that metrics can still be graphed,
+	// it is keyed separately so it cannot be matched against the /queue hash
+	mac := hmac.New(sha256.New, []byte(a.secret))
+	mac.Write([]byte("redact:" + target))
+	return "redacted-" + hex.EncodeToString(mac.Sum(nil))[:12], true
+}
+
+func (d *daemon) authorizeRead(r *http.Request, u *url.URL) readAccess {
+	access := readAccess{secret: d.secret}
+	if len(d.readToken) == 0 && len(d.readBasic) == 0 {
+		access.full = true
+		return access
+	}
+
+	if len(d.readToken) > 0 {
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") && secureEqual(auth[len("Bearer "):], d.readToken) {
+			access.full = true
+			return access
+		}
+	}
+
+	if len(d.readBasic) > 0 {
+		if username, password, ok := r.BasicAuth(); ok && secureEqual(username+":"+password, d.readBasic) {
+			access.full = true
+			return access
+		}
+	}
+
+	query := u.Query()
+	target := query.Get("target")
+	hash := query.Get("hash")
+	if len(target) > 0 && len(hash) > 0 && secureEqual(hash, internal.GetMD5(target, d.secret)) {
+		access.target = target
+	}
+
+	return access
+}
+
+// parseReadPrivate parses space separated read endpoints
+func parseReadPrivate(value string) (map[string]bool, error) {
+	private := make(map[string]bool)
+	for _, path := range strings.Fields(value) {
+		known := false
+		for _, endpoint := range readEndpoints {
+			known = known || endpoint == path
+		}
+		if !known {
+			return nil, fmt.Errorf("%q is not a read endpoint", path)
+		}
+
+		private[path] = true
+	}
+
+	return private, nil
+}
+
+func (d *daemon) rejectRead(w http.ResponseWriter) (int, error) {
+	if len(d.readToken) > 0 {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="go-deferred"`)
+	}
+	if len(d.readBasic) > 0 {
+		w.Header().Add("WWW-Authenticate", `Basic realm="go-deferred"`)
+	}
+
+	return http.StatusUnauthorized, nil
+}
+
+func secureEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -5,37 +5,84 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/daohoangson/go-deferred/internal"
+	"github.com/daohoangson/go-deferred/pkg/alert"
+	"github.com/daohoangson/go-deferred/pkg/clock"
 	"github.com/daohoangson/go-deferred/pkg/runner"
+	"github.com/daohoangson/go-deferred/pkg/store"
 )
 
 type daemon struct {
-	runner runner.Runner
-	logger *logrus.Logger
+	clock      clock.Clock
+	runner     runner.Runner
+	logger     *logrus.Logger
+	httpLogger *logrus.Logger
+
+	alertCircuitOpen uint64
+	alertNoSuccess   time.Duration
+	alerter          alert.Alerter
 
 	coolDown        time.Duration
 	cutOff          time.Duration
 	defaultSchedule time.Duration
+	lockTTL         time.Duration
+	nodeID          string
 	secret          string
-
-	queued sync.Map
-
-	stats      map[string]*Stats
-	statsMutex sync.Mutex
-
-	timerCounter uint64
-	timers       sync.Map
+	store           store.Store
+
+	queueLimitIP         *rateLimiter
+	queueLimitTarget     *rateLimiter
+	queueRejects         map[string]uint64
+	queueRejectsByIP     uint64
+	queueRejectsByTarget uint64
+	queueRejectsMutex    sync.Mutex
+	queueTrustForwarded  bool
+
+	readBasic   string
+	readPrivate map[string]bool
+	readToken   string
+
+	staleAfter         time.Duration
+	staleCadenceFactor uint64
+	stalePoll          bool
+
+	hitsMax          int
+	hitsRunning      int64
+	hitsWaiting      int64
+	priorityAging    time.Duration
+	targetPriorities []targetPriority
+	timerCounter     uint64
+	timers           sync.Map
+
+	counterSchedulesCoalesced uint64
+	counterTimersCancelled    uint64
+	counterTimersScheduled    uint64
+	scheduleCoalesceWindow    time.Duration
+	scheduleMutex             sync.Mutex
+	schedulePendingAt         time.Time
+	schedulesRunning          int
+	timerPendingCancel        chan struct{}
+	timerPendingCounter       uint64
 
 	wakeUpCounterStart  uint64
 	wakeUpCounterFinish uint64
+	wakeUpFinishedAt    time.Time
 	wakeUpMutex         sync.Mutex
 	wakeUpSignal        chan uint64
+	wakeUpStartedAt     time.Time
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
 }
 
 // New returns a new Deamon instance
@@ -46,18 +93,52 @@ func New(runner runner.Runner, logger *logrus.Logger) Daemon {
 }
 
 func (d *daemon) ListenAndServe(port uint64) error {
-	addr := fmt.Sprintf(":%d", port)
-	d.logger.WithField("addr", addr).Warn("Going to listen and serve now...")
+	return d.Listen(ListenConfig{Address: fmt.Sprintf(":%d", port)})
+}
 
-	var f http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
-		code, err := d.serve(w, r)
-		logger := d.logger.WithField("uri", r.RequestURI)
+func (d *daemon) SetAlerter(a alert.Alerter) {
+	d.alerter = a
+}
+
+func (d *daemon) SetSecret(secret string) {
+	d.secret = secret
+}
+
+func (d *daemon) SetStore(s store.Store) {
+	d.store = s
+
+	// a persisted or shared store may already have items, they must not wait for the next enqueue
+	d.step2Schedule("startup")
+}
+
+func (d *daemon) enqueueNow(url string) {
+	d.step1Enqueue(url, 0, "")
+}
+
+func (d *daemon) enqueueSeconds(url string, seconds int64) {
+	d.step1Enqueue(url, time.Duration(seconds)*time.Second, "")
+}
+
+func (d *daemon) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(internal.GetRequestIDHeaderKey())
+		if !isValidRequestID(requestID) {
+			requestID = internal.NewRequestID()
+		}
+		w.Header().Set(internal.GetRequestIDHeaderKey(), requestID)
+
+		sw := &statusWriter{ResponseWriter: w}
+		code, err := d.serve(sw, r)
+		logger := d.httpLogger.WithFields(logrus.Fields{
+			internal.LogFieldRequestID: requestID,
+			"uri":                      r.RequestURI,
+		})
 
 		if err != nil {
 			logger = logger.WithError(err)
 			code = http.StatusInternalServerError
 		}
-		if code != http.StatusOK {
+		if code != http.StatusOK && !sw.wroteHeader {
 			internal.RespondCode(w, code)
 		}
 
@@ -70,40 +151,193 @@ func (d *daemon) ListenAndServe(port uint64) error {
 			logger.Info("Responded")
 		}
 	}
-
-	return http.ListenAndServe(addr, f)
-}
-
-func (d *daemon) SetSecret(secret string) {
-	d.secret = secret
 }
 
-func (d *daemon) enqueueNow(url string) {
-	d.step1Enqueue(url, 0)
-}
+func (d *daemon) init(r runner.Runner, logger *logrus.Logger) {
+	if r == nil {
+		r = runner.New(nil, logger)
+	}
 
-func (d *daemon) enqueueSeconds(url string, seconds int64) {
-	d.step1Enqueue(url, time.Duration(seconds)*time.Second)
-}
+	d.httpLogger = logger
+	if d.httpLogger == nil {
+		d.httpLogger = internal.GetComponentLogger(internal.LogComponentHTTP)
+	}
 
-func (d *daemon) init(r runner.Runner, logger *logrus.Logger) {
 	if logger == nil {
-		logger = internal.GetLogger()
+		logger = internal.GetComponentLogger(internal.LogComponentScheduler)
 	}
 	d.logger = logger
 
-	if r == nil {
-		r = runner.New(nil, logger)
-	}
 	d.runner = r
+	d.clock = r.GetClock()
 
 	d.coolDown = time.Second
 
 	d.defaultSchedule = 30 * time.Second
 	d.cutOff = 300 * time.Second
 
-	d.stats = make(map[string]*Stats)
+	// the lock of a target is held during its loop, it should outlast any reasonable loop
+	d.lockTTL = 10 * time.Minute
+	d.nodeID = internal.NewRequestID()
+
+	d.store = store.NewMemory()
+
+	d.alerter = alert.New(d.clock, nil)
+
+	d.alertCircuitOpen = 3
+	alertCircuitOpenValue := os.Getenv("DEFERRED_ALERT_CIRCUIT_OPEN_AFTER")
+	if len(alertCircuitOpenValue) > 0 {
+		if alertCircuitOpen, err := strconv.ParseUint(alertCircuitOpenValue, 10, 64); err == nil {
+			d.alertCircuitOpen = alertCircuitOpen
+			logger.WithField("value", alertCircuitOpen).Info("Updated alert circuit open after")
+		}
+	}
+
+	d.alertNoSuccess = 6 * time.Hour
+	alertNoSuccessValue := os.Getenv("DEFERRED_ALERT_NO_SUCCESS_AFTER")
+	if len(alertNoSuccessValue) > 0 {
+		if alertNoSuccess, err := time.ParseDuration(alertNoSuccessValue); err == nil {
+			d.alertNoSuccess = alertNoSuccess
+			logger.WithField("value", alertNoSuccess).Info("Updated alert no success after")
+		}
+	}
+
+	// clients behind a proxy or on the socket share one address, the limit is opt-in
+	queueRatePerIP := 0.0
+	queueRatePerIPValue := os.Getenv("DEFERRED_QUEUE_RATE_PER_IP")
+	if len(queueRatePerIPValue) > 0 {
+		if rate, err := strconv.ParseFloat(queueRatePerIPValue, 64); err == nil {
+			queueRatePerIP = rate
+			logger.WithField("value", rate).Info("Updated queue rate per IP")
+		}
+	}
+	queueBurstPerIP := 2 * queueRatePerIP
+	queueBurstPerIPValue := os.Getenv("DEFERRED_QUEUE_BURST_PER_IP")
+	if len(queueBurstPerIPValue) > 0 {
+		if burst, err := strconv.ParseFloat(queueBurstPerIPValue, 64); err == nil {
+			queueBurstPerIP = burst
+			logger.WithField("value", burst).Info("Updated queue burst per IP")
+		}
+	}
+	d.queueLimitIP = newRateLimiter(queueRatePerIP, queueBurstPerIP)
+
+	queueRatePerTarget := 1.0
+	queueRatePerTargetValue := os.Getenv("DEFERRED_QUEUE_RATE_PER_TARGET")
+	if len(queueRatePerTargetValue) > 0 {
+		if rate, err := strconv.ParseFloat(queueRatePerTargetValue, 64); err == nil {
+			queueRatePerTarget = rate
+			logger.WithField("value", rate).Info("Updated queue rate per target")
+		}
+	}
+	queueBurstPerTarget := 10 * queueRatePerTarget
+	queueBurstPerTargetValue := os.Getenv("DEFERRED_QUEUE_BURST_PER_TARGET")
+	if len(queueBurstPerTargetValue) > 0 {
+		if burst, err := strconv.ParseFloat(queueBurstPerTargetValue, 64); err == nil {
+			queueBurstPerTarget = burst
+			logger.WithField("value", burst).Info("Updated queue burst per target")
+		}
+	}
+	d.queueLimitTarget = newRateLimiter(queueRatePerTarget, queueBurstPerTarget)
+	d.queueRejects = make(map[string]uint64)
+
+	queueTrustForwardedValue := os.Getenv("DEFERRED_QUEUE_TRUST_FORWARDED")
+	if len(queueTrustForwardedValue) > 0 {
+		d.queueTrustForwarded = queueTrustForwardedValue == "true" ||
+			queueTrustForwardedValue == "yes" ||
+			queueTrustForwardedValue == "1"
+		logger.WithField("value", d.queueTrustForwarded).Info("Updated queue trust forwarded")
+	}
+
+	d.readBasic = os.Getenv("DEFERRED_READ_BASIC")
+	if len(d.readBasic) > 0 {
+		if !strings.Contains(d.readBasic, ":") {
+			logger.Warn("Read basic auth should be username:password")
+		}
+		logger.Info("Updated read basic auth")
+	}
+
+	d.readToken = os.Getenv("DEFERRED_READ_TOKEN")
+	if len(d.readToken) > 0 {
+		logger.Info("Updated read token")
+	}
 
+	readPrivateValue := os.Getenv("DEFERRED_READ_PRIVATE")
+	if len(readPrivateValue) > 0 {
+		if readPrivate, err := parseReadPrivate(readPrivateValue); err == nil {
+			d.readPrivate = readPrivate
+			logger.WithField("value", readPrivateValue).Info("Updated read private endpoints")
+		} else {
+			logger.WithError(err).Warn("Could not parse read private endpoints")
+		}
+
+		if len(d.readBasic) == 0 && len(d.readToken) == 0 {
+			logger.Warn("Read private endpoints are public without a read token or basic auth")
+		}
+	}
+
+	d.scheduleCoalesceWindow = 100 * time.Millisecond
+	scheduleCoalesceWindowValue := os.Getenv("DEFERRED_SCHEDULE_COALESCE_WINDOW")
+	if len(scheduleCoalesceWindowValue) > 0 {
+		if scheduleCoalesceWindow, err := time.ParseDuration(scheduleCoalesceWindowValue); err == nil {
+			d.scheduleCoalesceWindow = scheduleCoalesceWindow
+			logger.WithField("value", scheduleCoalesceWindow).Info("Updated schedule coalesce window")
+		}
+	}
+
+	d.staleAfter = time.Hour
+	staleAfterValue := os.Getenv("DEFERRED_STALE_AFTER")
+	if len(staleAfterValue) > 0 {
+		if staleAfter, err := time.ParseDuration(staleAfterValue); err == nil {
+			d.staleAfter = staleAfter
+			logger.WithField("value", staleAfter).Info("Updated stale after")
+		}
+	}
+
+	d.staleCadenceFactor = 4
+	staleCadenceFactorValue := os.Getenv("DEFERRED_STALE_CADENCE_FACTOR")
+	if len(staleCadenceFactorValue) > 0 {
+		if staleCadenceFactor, err := strconv.ParseUint(staleCadenceFactorValue, 10, 64); err == nil {
+			d.staleCadenceFactor = staleCadenceFactor
+			logger.WithField("value", staleCadenceFactor).Info("Updated stale cadence factor")
+		}
+	}
+
+	stalePollValue := os.Getenv("DEFERRED_STALE_POLL")
+	if len(stalePollValue) > 0 {
+		d.stalePoll = stalePollValue == "true" ||
+			stalePollValue == "yes" ||
+			stalePollValue == "1"
+		logger.WithField("value", d.stalePoll).Info("Updated stale poll")
+	}
+
+	hitsMaxValue := os.Getenv("DEFERRED_MAX_CONCURRENT_HITS")
+	if len(hitsMaxValue) > 0 {
+		if hitsMax, err := strconv.ParseUint(hitsMaxValue, 10, 32); err == nil {
+			d.hitsMax = int(hitsMax)
+			logger.WithField("value", hitsMax).Info("Updated max concurrent hits")
+		}
+	}
+
+	d.priorityAging = time.Minute
+	priorityAgingValue := os.Getenv("DEFERRED_PRIORITY_AGING")
+	if len(priorityAgingValue) > 0 {
+		if priorityAging, err := time.ParseDuration(priorityAgingValue); err == nil {
+			d.priorityAging = priorityAging
+			logger.WithField("value", priorityAging).Info("Updated priority aging")
+		}
+	}
+
+	targetPrioritiesValue := os.Getenv("DEFERRED_TARGET_PRIORITIES")
+	if len(targetPrioritiesValue) > 0 {
+		if targetPriorities, err := parseTargetPriorities(targetPrioritiesValue); err == nil {
+			d.targetPriorities = targetPriorities
+			logger.WithField("value", targetPrioritiesValue).Info("Updated target priorities")
+		} else {
+			logger.WithError(err).Warn("Could not parse target priorities")
+		}
+	}
+
+	d.wakeUpFinishedAt = d.clock.Now()
 	d.wakeUpSignal = make(chan uint64, 42)
 	go func(c chan uint64) {
 		for {
@@ -124,7 +358,7 @@ func (d *daemon) init(r runner.Runner, logger *logrus.Logger) {
 
 func (d *daemon) getTimerSoon() *time.Time {
 	var soon *time.Time
-	now := time.Now()
+	now := d.clock.Now()
 
 	d.timers.Range(func(key, value interface{}) bool {
 		if t, ok := value.(time.Time); ok {
@@ -156,33 +390,34 @@ func (d *daemon) hasTimers() bool {
 	return result
 }
 
-func (d *daemon) loadStats(url string) *Stats {
-	var stats *Stats
-	if statsValue, ok := d.stats[url]; ok {
-		stats = statsValue
-	}
-	if stats == nil {
-		stats = &Stats{}
-	}
-
-	return stats
-}
-
 func (d *daemon) serve(w http.ResponseWriter, r *http.Request) (int, error) {
 	u, err := url.Parse(r.RequestURI)
 	if err != nil {
 		return 0, err
 	}
 
+	access := d.authorizeRead(r, u)
+	if d.readPrivate[u.Path] && !access.isAuthenticated() {
+		return d.rejectRead(w)
+	}
+
 	switch u.Path {
+	case "/debug/scheduler":
+		return d.serveDebugScheduler(w, u)
 	case "/favicon.ico":
 		return d.serveFavicon(w, u)
+	case "/healthz":
+		return d.serveHealthz(w, u)
+	case "/metrics":
+		return d.serveMetrics(w, u, access)
 	case "/queue":
-		return d.serveQueue(w, u)
+		return d.serveQueue(w, r, u)
 	case "/queued":
-		return d.serveQueued(w, u)
+		return d.serveQueued(w, u, access)
+	case "/readyz":
+		return d.serveReadyz(w, u)
 	case "/stats":
-		return d.serveStats(w, u)
+		return d.serveStats(w, u, access)
 	}
 
 	return http.StatusNotFound, nil
@@ -201,11 +436,20 @@ func (d *daemon) serveFavicon(w http.ResponseWriter, u *url.URL) (int, error) {
 	return http.StatusOK, nil
 }
 
-func (d *daemon) serveQueue(w http.ResponseWriter, u *url.URL) (int, error) {
+func (d *daemon) serveQueue(w http.ResponseWriter, r *http.Request, u *url.URL) (int, error) {
 	query := u.Query()
 	hash := query.Get("hash")
 	target := query.Get("target")
 	delayValue := query.Get("delay")
+
+	now := d.clock.Now()
+	if ip := getClientIP(r, d.queueTrustForwarded); len(ip) > 0 {
+		if wait := d.queueLimitIP.take(ip, now); wait > 0 {
+			// the target is not authenticated yet, it is not counted
+			return d.rejectQueue(w, "", wait, &d.queueRejectsByIP)
+		}
+	}
+
 	if len(target) == 0 || len(hash) == 0 {
 		return http.StatusBadRequest, nil
 	}
@@ -215,25 +459,35 @@ func (d *daemon) serveQueue(w http.ResponseWriter, u *url.URL) (int, error) {
 		return http.StatusForbidden, nil
 	}
 
+	if wait := d.queueLimitTarget.take(target, now); wait > 0 {
+		return d.rejectQueue(w, target, wait, &d.queueRejectsByTarget)
+	}
+
 	delay, _ := strconv.ParseInt(delayValue, 10, 64)
-	go d.enqueueSeconds(target, delay)
+	priority, _ := strconv.Atoi(query.Get("priority"))
+	priority = d.limitPriority(target, priority)
+	requestID := w.Header().Get(internal.GetRequestIDHeaderKey())
+	go func() {
+		d.trackQueue(target)
+		d.step1EnqueuePriority(target, time.Duration(delay)*time.Second, requestID, priority)
+	}()
 
 	return http.StatusAccepted, nil
 }
 
-func (d *daemon) serveQueued(w http.ResponseWriter, u *url.URL) (int, error) {
-	queued := make(map[string]float64)
-	now := time.Now()
+func (d *daemon) serveQueued(w http.ResponseWriter, u *url.URL, access readAccess) (int, error) {
+	items, err := d.store.GetQueued()
+	if err != nil {
+		return 0, err
+	}
 
-	d.queued.Range(func(key, value interface{}) bool {
-		if url, ok := key.(string); ok {
-			if t, ok := value.(time.Time); ok {
-				queued[url] = t.Sub(now).Seconds()
-			}
+	queued := make(map[string]float64)
+	now := d.clock.Now()
+	for _, item := range items {
+		if name, ok := access.name(item.URL); ok {
+			queued[name] = item.Time.Sub(now).Seconds()
 		}
-
-		return true
-	})
+	}
 
 	json, err := json.Marshal(queued)
 	if err != nil {
@@ -244,11 +498,34 @@ func (d *daemon) serveQueued(w http.ResponseWriter, u *url.URL) (int, error) {
 	return http.StatusOK, nil
 }
 
-func (d *daemon) serveStats(w http.ResponseWriter, u *url.URL) (int, error) {
-	d.statsMutex.Lock()
-	json, err := json.Marshal(d.stats)
-	d.statsMutex.Unlock()
+func (d *daemon) serveStats(w http.ResponseWriter, u *url.URL, access readAccess) (int, error) {
+	all, err := d.store.GetStatsAll()
+	if err != nil {
+		return 0, err
+	}
+
+	stats := make(map[string]statsResponse)
+	now := d.clock.Now()
+	for url, s := range all {
+		if name, ok := access.name(url); ok {
+			stats[name] = statsResponse{Stats: s, Stale: d.isStale(s, now)}
+		}
+	}
 
+	d.queueRejectsMutex.Lock()
+	for url, rejects := range d.queueRejects {
+		name, ok := access.name(url)
+		if !ok {
+			continue
+		}
+
+		s := stats[name]
+		s.CounterRejects = rejects
+		stats[name] = s
+	}
+	d.queueRejectsMutex.Unlock()
+
+	json, err := json.Marshal(stats)
 	if err != nil {
 		return 0, err
 	}
@@ -257,45 +534,87 @@ func (d *daemon) serveStats(w http.ResponseWriter, u *url.URL) (int, error) {
 	return http.StatusOK, nil
 }
 
-func (d *daemon) step1Enqueue(url string, delay time.Duration) {
-	now := time.Now()
-	t := now
+func (d *daemon) step1Enqueue(url string, delay time.Duration, requestID string) {
+	d.step1EnqueuePriority(url, delay, requestID, 0)
+}
+
+func (d *daemon) step1EnqueuePriority(url string, delay time.Duration, requestID string, priority int) {
+	t := d.clock.Now()
 	if delay > 0 {
 		t = t.Add(delay)
 	}
+
+	d.step1EnqueueItem(store.Item{URL: url, Time: t, RequestID: requestID, Priority: priority})
+}
+
+func (d *daemon) step1EnqueueItem(item store.Item) {
+	now := d.clock.Now()
+	url := item.URL
 	logger := d.logger.WithFields(logrus.Fields{
-		"!": "Enqu",
-		"_": url,
-		"t": t.Sub(now).Seconds(),
+		internal.LogFieldRequestID: item.RequestID,
+		internal.LogFieldStep:      "enqueue",
+		internal.LogFieldTarget:    url,
+		"t":                        item.Time.Sub(now).Seconds(),
 	})
-
-	var existing time.Time
-	if existingValue, ok := d.queued.Load(url); ok {
-		if existingTime, ok := existingValue.(time.Time); ok {
-			existing = existingTime
-			logger = logger.WithField("existing", existing.Sub(now).Seconds())
-		}
+	if item.Priority != 0 {
+		logger = logger.WithField("priority", item.Priority)
 	}
 
-	if now.Before(existing) && existing.Before(t) {
+	stored, err := d.store.Enqueue(item, now)
+	if err != nil {
+		logger.WithError(err).Error("Could not store")
+		return
+	}
+	if !stored {
 		logger.Debug("Skipped")
 		return
 	}
-
-	d.queued.Store(url, t)
 	logger.Debug("Stored")
 
-	d.statsMutex.Lock()
-	stats := d.loadStats(url)
-	stats.CounterEnqueues++
-	d.stats[url] = stats
-	d.statsMutex.Unlock()
+	if _, err := d.store.UpdateStats(url, func(stats *Stats) {
+		stats.CounterEnqueues++
+	}); err != nil {
+		logger.WithError(err).Error("Could not update stats")
+	}
 
-	d.step2Schedule("step1")
+	d.coalesceSchedule("step1")
+}
+
+// coalesceSchedule delays scheduling for a short window so a burst of enqueues results in one schedule
+func (d *daemon) coalesceSchedule(from string) {
+	if d.scheduleCoalesceWindow <= 0 {
+		d.step2Schedule(from)
+		return
+	}
+
+	d.scheduleMutex.Lock()
+	if !d.schedulePendingAt.IsZero() {
+		d.scheduleMutex.Unlock()
+		atomic.AddUint64(&d.counterSchedulesCoalesced, 1)
+		return
+	}
+	d.schedulePendingAt = d.clock.Now().Add(d.scheduleCoalesceWindow)
+	d.schedulesRunning++
+	d.scheduleMutex.Unlock()
+
+	go func(c <-chan time.Time) {
+		<-c
+
+		// enqueues from now on need another schedule as the store may be read before they are stored
+		d.scheduleMutex.Lock()
+		d.schedulePendingAt = time.Time{}
+		d.scheduleMutex.Unlock()
+
+		d.step2Schedule(from)
+
+		d.scheduleMutex.Lock()
+		d.schedulesRunning--
+		d.scheduleMutex.Unlock()
+	}(d.clock.After(d.scheduleCoalesceWindow))
 }
 
 func (d *daemon) step2Schedule(from string) {
-	now := time.Now()
+	now := d.clock.Now()
 	initialNext := now.Add(24 * time.Hour)
 	next := initialNext
 	cutOff := now.Add(-d.cutOff)
@@ -304,24 +623,21 @@ func (d *daemon) step2Schedule(from string) {
 		next = now.Add(d.defaultSchedule)
 	}
 
-	d.queued.Range(func(key, value interface{}) bool {
-		if t, ok := value.(time.Time); ok {
-			if cutOff.Before(t) && t.Before(next) {
-				next = t
-			}
-		} else {
-			d.queued.Delete(key)
-		}
-
-		return true
-	})
-
 	logger := d.logger.WithFields(logrus.Fields{
-		"!":    "Sche",
-		"from": from,
-		"next": next.Sub(now).Seconds(),
+		internal.LogFieldStep: "schedule",
+		"from":                from,
 	})
 
+	if queuedNext, ok, err := d.store.GetNext(cutOff); err != nil {
+		logger.WithError(err).Error("Could not get next")
+	} else if ok && queuedNext.Before(next) {
+		next = queuedNext
+	}
+	logger = logger.WithField("next", next.Sub(now).Seconds())
+
+	d.scheduleMutex.Lock()
+	defer d.scheduleMutex.Unlock()
+
 	var newCounter uint64
 	if next.Before(initialNext) {
 		timerNeeded := false
@@ -346,86 +662,141 @@ func (d *daemon) step2Schedule(from string) {
 		return
 	}
 
-	go func(next, now time.Time, counter uint64) {
-		d.timers.Store(counter, next)
-
-		if now.Before(next) {
-			<-time.After(next.Sub(now))
+	// keep at most one pending timer, the new one is always earlier
+	if d.timerPendingCancel != nil {
+		if t, ok := d.timers.Load(d.timerPendingCounter); ok && t.(time.Time).After(now) {
+			close(d.timerPendingCancel)
+			d.timers.Delete(d.timerPendingCounter)
+			atomic.AddUint64(&d.counterTimersCancelled, 1)
 		}
-
-		d.wakeUpSignal <- counter
-	}(next, now, newCounter)
+	}
+	cancel := make(chan struct{})
+	d.timerPendingCancel = cancel
+	d.timerPendingCounter = newCounter
+
+	d.timers.Store(newCounter, next)
+	atomic.AddUint64(&d.counterTimersScheduled, 1)
+	go func(c <-chan time.Time, cancel <-chan struct{}, counter uint64) {
+		select {
+		case <-c:
+			d.wakeUpSignal <- counter
+		case <-cancel:
+		}
+	}(d.clock.After(next.Sub(now)), cancel, newCounter)
 	logger.Info("Scheduled")
 }
 
 func (d *daemon) step3WakeUp(counter uint64) {
-	now := time.Now()
+	now := d.clock.Now()
 	logger := d.logger.WithFields(logrus.Fields{
-		"!":       "WkUp",
-		"counter": counter,
+		internal.LogFieldStep: "wake_up",
+		"counter":             counter,
 	})
 
 	d.wakeUpMutex.Lock()
 	logger.Info("Running...")
 	d.wakeUpCounterStart++
+	d.wakeUpStartedAt = now
 	d.wakeUpMutex.Unlock()
 
-	var wg sync.WaitGroup
+	due, err := d.store.GetDue(now)
+	if err != nil {
+		logger.WithError(err).Error("Could not get due items")
+	}
 
-	d.queued.Range(func(key, value interface{}) bool {
-		if t, ok := value.(time.Time); ok {
-			if t.Before(now) {
-				wg.Add(1)
-				go func(key interface{}, t time.Time) {
-					d.step4Hit(key, t)
-					wg.Done()
-				}(key, t)
-			} else {
-				logger.WithFields(logrus.Fields{
-					"_": key,
-					"t": t.Unix(),
-				}).Debug("Skipped")
-			}
-		}
+	d.sortDue(due, now)
+	items := make(chan store.Item, len(due))
+	for _, item := range due {
+		items <- item
+	}
+	close(items)
 
-		return true
-	})
+	// each worker takes the next item by priority as soon as it is free
+	workers := len(due)
+	if d.hitsMax > 0 && workers > d.hitsMax {
+		workers = d.hitsMax
+	}
+
+	var wg sync.WaitGroup
+	atomic.AddInt64(&d.hitsWaiting, int64(len(due)))
+	atomic.AddInt64(&d.hitsRunning, int64(workers))
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			for item := range items {
+				atomic.AddInt64(&d.hitsWaiting, -1)
+				d.step4Hit(item)
+			}
+			atomic.AddInt64(&d.hitsRunning, -1)
+			wg.Done()
+		}()
+	}
 
 	wg.Wait()
 
+	if d.stalePoll {
+		d.pollStale(d.clock.Now())
+	}
+
 	d.timers.Delete(counter)
+	d.scheduleMutex.Lock()
+	if d.timerPendingCounter == counter {
+		d.timerPendingCancel = nil
+	}
+	d.scheduleMutex.Unlock()
+
 	if !d.hasTimers() {
-		time.Sleep(d.coolDown)
+		d.clock.Sleep(d.coolDown)
 		d.step2Schedule("step3")
 	}
 
 	d.wakeUpMutex.Lock()
 	d.wakeUpCounterFinish++
+	d.wakeUpFinishedAt = d.clock.Now()
 	d.wakeUpMutex.Unlock()
 }
 
-func (d *daemon) step4Hit(key interface{}, t time.Time) {
+func (d *daemon) step4Hit(item store.Item) {
+	url := item.URL
+	requestID := item.RequestID
 	logger := d.logger.WithFields(logrus.Fields{
-		"!": "Hitt",
-		"_": key,
+		internal.LogFieldStep:   "hit",
+		internal.LogFieldTarget: url,
 	})
+	if len(requestID) > 0 {
+		logger = logger.WithField(internal.LogFieldRequestID, requestID)
+	}
 
-	url, ok := key.(string)
-	if !ok {
-		logger.Error("Failed type assertion")
-		return
+	if locker, ok := d.store.(store.Locker); ok {
+		locked, err := locker.Lock(url, d.nodeID, d.clock.Now(), d.lockTTL)
+		if err != nil {
+			logger.WithError(err).Error("Could not lock")
+			return
+		}
+		if !locked {
+			logger.Debug("Locked by another daemon")
+			return
+		}
+
+		defer func() {
+			if err := locker.Unlock(url, d.nodeID); err != nil {
+				logger.WithError(err).Error("Could not unlock")
+			}
+		}()
 	}
 
-	d.statsMutex.Lock()
-	prevStats := d.loadStats(url)
-	prevStats.CounterWakeUps++
-	d.stats[url] = prevStats
+	prevStats, err := d.store.UpdateStats(url, func(stats *Stats) {
+		stats.CounterWakeUps++
+	})
+	if err != nil {
+		logger.WithError(err).Error("Could not update stats")
+		return
+	}
 	isURLFirstHit := prevStats.CounterWakeUps == 1
-	d.statsMutex.Unlock()
 
 	skip := false
 	if !isURLFirstHit {
-		lastHitSubT := prevStats.LastHit.Sub(t)
+		lastHitSubT := prevStats.LastHit.Sub(item.Time)
 		logger = logger.WithField("lastHitSubT", lastHitSubT)
 		if lastHitSubT > 0 {
 			skip = true
@@ -436,39 +807,123 @@ func (d *daemon) step4Hit(key interface{}, t time.Time) {
 		return
 	}
 
-	hits, err := runner.Loop(d.runner, url)
+	hits, err := runner.LoopWithRequestID(d.runner, url, requestID)
 	counter := len(hits.List)
 	logger = logger.WithFields(logrus.Fields{
 		"counter": counter,
 		"elapsed": hits.TimeElapsed,
 	})
 
-	d.statsMutex.Lock()
-	stats := d.loadStats(url)
-	stats.CounterLoops += uint64(counter)
-	if err == nil {
-		stats.LastHit = t.Add(time.Nanosecond)
+	var prevConsecutiveErrors uint64
+	if stats, statsErr := d.store.UpdateStats(url, func(stats *Stats) {
+		prevConsecutiveErrors = stats.ConsecutiveErrors
+		stats.CounterLoops += uint64(counter)
+		if err == nil {
+			stats.ConsecutiveErrors = 0
+			stats.LastHit = item.Time.Add(time.Nanosecond)
+			stats.ProtocolVersion = hits.ProtocolVersion
+		} else {
+			stats.ConsecutiveErrors++
+			stats.CounterErrors++
+		}
+		if internal.HasProtocolFeature(hits.ProtocolVersion, internal.ProtocolFeatureProgress) {
+			if progress := aggregateProgress(stats.Progress, hits, d.clock.Now()); progress != nil {
+				stats.Progress = progress
+			}
+		}
+	}); statsErr != nil {
+		logger.WithError(statsErr).Error("Could not update stats")
 	} else {
-		stats.CounterErrors++
-		logger.WithError(err)
+		d.notifyAlerts(url, prevConsecutiveErrors, stats, err)
+	}
+	if err != nil {
+		logger = logger.WithError(err)
 	}
-	d.stats[url] = stats
-	d.statsMutex.Unlock()
 
 	if err == nil {
 		// hits will always have at least one hit
 		lastHit := hits.List[counter-1]
-		if lastHit.HasEnqueue {
-			logger = logger.WithField("enqueue", lastHit.Enqueue)
-			d.enqueueSeconds(url, lastHit.Enqueue)
-		} else if lastHit.Data.MoreDeferred || lastHit.Data.More {
-			logger = logger.WithField("more?", 1)
-			d.enqueueNow(url)
+		hint := lastHit.EnqueueHint
+		if hint == nil && lastHit.HasEnqueue {
+			hint = &runner.EnqueueHint{Delay: time.Duration(lastHit.Enqueue) * time.Second}
+		}
+
+		if hint != nil && hint.Stop {
+			logger = logger.WithField("enqueue", "stop")
+			d.stopTarget(url, logger)
+		} else if hint != nil {
+			t := hint.Time(d.clock.Now())
+			logger = logger.WithField("enqueue", t.Sub(d.clock.Now()).Seconds())
+
+			// the priority of the item is kept unless the target sends another one
+			priority := item.Priority
+			if hint.Priority != 0 {
+				priority = d.limitPriority(url, hint.Priority)
+			}
+			d.step1EnqueueItem(store.Item{URL: url, Time: t, RequestID: requestID, Priority: priority})
+		} else if hits.StopReason.HasMore() {
+			logger = logger.WithField("reason", hits.StopReason)
+			d.step1EnqueuePriority(url, 0, requestID, item.Priority)
 		}
 
 		logger.Debug("Succeeded")
 	} else {
 		logger.Error("Failed")
-		time.Sleep(d.coolDown)
+		d.clock.Sleep(d.coolDown)
+	}
+}
+
+func (d *daemon) notifyAlerts(url string, prevConsecutiveErrors uint64, stats Stats, err error) {
+	e := alert.Event{
+		ConsecutiveErrors: stats.ConsecutiveErrors,
+		LastHit:           stats.LastHit,
+		Target:            url,
+		Time:              d.clock.Now(),
+	}
+
+	if err == nil {
+		if prevConsecutiveErrors > 0 {
+			e.Kind = alert.KindRecovery
+			e.Message = fmt.Sprintf("Succeeded after %d failed loops", prevConsecutiveErrors)
+			d.alerter.Notify(e)
+		}
+
+		return
+	}
+
+	e.Message = err.Error()
+	if prevConsecutiveErrors == 0 {
+		e.Kind = alert.KindFirstFailure
+		d.alerter.Notify(e)
 	}
+
+	if stats.ConsecutiveErrors == d.alertCircuitOpen {
+		e.Kind = alert.KindCircuitOpen
+		d.alerter.Notify(e)
+	}
+
+	if d.alertNoSuccess > 0 && !stats.LastHit.IsZero() && e.Time.Sub(stats.LastHit) >= d.alertNoSuccess {
+		e.Kind = alert.KindNoSuccess
+		e.Message = fmt.Sprintf("No successful hit since %s: %s", stats.LastHit.Format(time.RFC3339), err)
+		d.alerter.Notify(e)
+	}
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func isValidRequestID(requestID string) bool {
+	if len(requestID) == 0 || len(requestID) > 64 {
+		return false
+	}
+
+	for _, r := range requestID {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && r != '-' && r != '_' {
+			return false
+		}
+	}
+
+	return true
 }
@@ -1,10 +1,36 @@
 package daemon // import "github.com/daohoangson/go-deferred/pkg/daemon"
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/daohoangson/go-deferred/internal"
+	"github.com/daohoangson/go-deferred/pkg/alert"
+	"github.com/daohoangson/go-deferred/pkg/clock"
 	"github.com/daohoangson/go-deferred/pkg/runner"
+	"github.com/daohoangson/go-deferred/pkg/store"
+	"github.com/daohoangson/go-deferred/pkg/testserver"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -56,29 +82,265 @@ func TestDefaultSchedule(t *testing.T) {
 
 	d.enqueueNow(url)
 
-	time.Sleep(time.Second)
-	d.statsMutex.Lock()
-	stats1, _ := d.stats[url]
-	assert.NotNil(t, stats1)
-	counterLoops1 := stats1.CounterLoops
-	counterWakeUps1 := stats1.CounterWakeUps
-	d.statsMutex.Unlock()
-	assert.Equal(t, uint64(1), counterLoops1)
-	assert.True(t, counterWakeUps1 > 1)
-
-	time.Sleep(time.Second)
-	d.statsMutex.Lock()
-	stats2, _ := d.stats[url]
-	assert.NotNil(t, stats2)
-	counterLoops2 := stats2.CounterLoops
-	counterWakeUps2 := stats2.CounterWakeUps
-	d.statsMutex.Unlock()
-	assert.Equal(t, uint64(1), counterLoops2)
-	assert.True(t, counterWakeUps2 > counterWakeUps1)
+	advanceDaemon(d, time.Second)
+	stats1 := getStats(t, d, url)
+	assert.Equal(t, uint64(1), stats1.CounterLoops)
+	assert.True(t, stats1.CounterWakeUps > 1)
+
+	advanceDaemon(d, time.Second)
+	stats2 := getStats(t, d, url)
+	assert.Equal(t, uint64(1), stats2.CounterLoops)
+	assert.True(t, stats2.CounterWakeUps > stats1.CounterWakeUps)
 
 	d.wakeUpSignal <- 0
 }
 
+func TestCoalesce(t *testing.T) {
+	d := testInit(
+		runner.MockedHit{},
+		runner.MockedHit{},
+		runner.MockedHit{},
+		runner.MockedHit{},
+	)
+	d.scheduleCoalesceWindow = 100 * time.Millisecond
+	url1 := "coalesce-1"
+	url2 := "coalesce-2"
+
+	d.enqueueSeconds(url1, 10)
+	d.enqueueSeconds(url2, 5)
+	d.enqueueNow(url1)
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&d.counterSchedulesCoalesced))
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&d.counterTimersScheduled))
+
+	advanceDaemon(d, 50*time.Millisecond)
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&d.counterTimersScheduled))
+
+	waitForDaemon(d)
+	assert.Equal(t, uint64(1), getStats(t, d, url1).CounterLoops)
+	assert.Equal(t, uint64(1), getStats(t, d, url2).CounterLoops)
+
+	// a later enqueue joins the pending timer, an earlier one replaces it
+	scheduled := atomic.LoadUint64(&d.counterTimersScheduled)
+	d.enqueueSeconds(url1, 10)
+	advanceDaemon(d, time.Second)
+	d.enqueueSeconds(url2, 20)
+	advanceDaemon(d, time.Second)
+	assert.Equal(t, scheduled+1, atomic.LoadUint64(&d.counterTimersScheduled))
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&d.counterTimersCancelled))
+
+	d.enqueueSeconds(url2, 1)
+	advanceDaemon(d, time.Second/2)
+	assert.Equal(t, scheduled+2, atomic.LoadUint64(&d.counterTimersScheduled))
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&d.counterTimersCancelled))
+
+	pending := 0
+	d.timers.Range(func(key, value interface{}) bool {
+		pending++
+		return true
+	})
+	assert.Equal(t, 1, pending)
+
+	waitForDaemon(d)
+	assert.Equal(t, uint64(2), getStats(t, d, url1).CounterLoops)
+	assert.Equal(t, uint64(2), getStats(t, d, url2).CounterLoops)
+	metrics := serveDaemon(t, d, "/metrics")
+	assert.Contains(t, metrics, "deferred_schedule_coalesced_total 2\n")
+	assert.Contains(t, metrics, "deferred_timers_cancelled_total 1\n")
+}
+
+func TestProgress(t *testing.T) {
+	remaining := uint64(10)
+	d := testInit(
+		runner.MockedHit{
+			MoreDeferred:    true,
+			ProtocolVersion: internal.GetProtocolVersion(),
+			Progress: &runner.Progress{
+				Jobs:      []runner.JobProgress{{Name: "XF:Cron", Duration: 0.5}, {Name: "XF:Rebuild", Duration: 1}},
+				Remaining: &remaining,
+			},
+		},
+		runner.MockedHit{
+			ProtocolVersion: internal.GetProtocolVersion(),
+			Progress: &runner.Progress{
+				Jobs:    []runner.JobProgress{{Name: "XF:Rebuild", Duration: 2}},
+				Current: &runner.JobProgress{Name: "XF:Rebuild", Percent: 50},
+			},
+		},
+		// an older target is not expected to report progress
+		runner.MockedHit{
+			ProtocolVersion: "2018061901",
+			Progress:        &runner.Progress{Jobs: []runner.JobProgress{{Name: "XF:Ignored"}}},
+		},
+	)
+	url := "progress"
+
+	d.enqueueNow(url)
+	waitForDaemon(d)
+
+	stats := getStats(t, d, url)
+	if assert.NotNil(t, stats.Progress) {
+		assert.Equal(t, uint64(3), stats.Progress.CounterJobs)
+		assert.Equal(t, uint64(2), stats.Progress.Jobs["XF:Rebuild"].Count)
+		assert.Equal(t, 3*time.Second, stats.Progress.Jobs["XF:Rebuild"].Duration)
+		assert.Equal(t, "XF:Rebuild", stats.Progress.Current)
+		assert.Nil(t, stats.Progress.Remaining)
+	}
+
+	metrics := serveDaemon(t, d, "/metrics")
+	assert.Contains(t, metrics, "deferred_target_jobs_total{target=\"progress\"} 3\n")
+	assert.Contains(t, metrics, "deferred_target_job_runs_total{target=\"progress\",job=\"XF:Cron\"} 1\n")
+	assert.Contains(t, metrics, "deferred_target_current_job_percent{target=\"progress\",job=\"XF:Rebuild\"} 50\n")
+
+	d.enqueueNow(url)
+	waitForDaemon(d)
+
+	stats = getStats(t, d, url)
+	assert.Equal(t, "2018061901", stats.ProtocolVersion)
+	assert.Equal(t, uint64(3), stats.Progress.CounterJobs)
+	_, ignored := stats.Progress.Jobs["XF:Ignored"]
+	assert.False(t, ignored)
+}
+
+func TestEnqueueHint(t *testing.T) {
+	url := "enqueue-hint"
+	r := runner.NewScripted(&runner.Scenario{
+		Targets: map[string]*runner.Script{
+			url: &runner.Script{Hits: []runner.ScriptedHit{
+				// the fake clock starts at 1529366400
+				runner.ScriptedHit{EnqueueHeader: "delay=30; not-before=1529366460; priority=5", ProtocolVersion: internal.GetProtocolVersion()},
+				runner.ScriptedHit{EnqueueHeader: "stop", ProtocolVersion: internal.GetProtocolVersion()},
+			}},
+		},
+	}, clock.NewTestFake())
+	d := &daemon{}
+	d.init(r, nil)
+	configDaemon(d)
+	d.staleAfter = time.Second
+	d.stalePoll = true
+	d.targetPriorities, _ = parseTargetPriorities(url + "=10")
+
+	d.enqueueNow(url)
+	advanceDaemon(d, 10*time.Second)
+
+	queued, err := d.store.GetQueued()
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(queued)) {
+		assert.Equal(t, time.Unix(1529366460, 0), queued[0].Time.Truncate(time.Second))
+		assert.Equal(t, 5, queued[0].Priority)
+	}
+
+	waitForDaemon(d)
+	calls := r.Calls()
+	assert.Equal(t, 2, len(calls))
+	assert.Equal(t, time.Minute, calls[1].Hit.TimeStart.Sub(calls[0].Hit.TimeStart))
+
+	queued, _ = d.store.GetQueued()
+	assert.Equal(t, 0, len(queued))
+	stats := getStats(t, d, url)
+	assert.True(t, stats.Stopped)
+	assert.False(t, stats.Polling)
+}
+
+func TestPriority(t *testing.T) {
+	hit := time.Second
+	d := testInit(
+		runner.MockedHit{Duration: hit},
+		runner.MockedHit{Duration: hit},
+		runner.MockedHit{Duration: hit},
+	)
+	d.hitsMax = 1
+	d.targetPriorities, _ = parseTargetPriorities("priority-high=5")
+	urlLow := "priority-low"
+	urlMid := "priority-mid"
+	urlHigh := "priority-high"
+
+	d.enqueueSeconds(urlLow, 1)
+	d.step1EnqueuePriority(urlMid, time.Second, "", 3)
+	d.enqueueSeconds(urlHigh, 1)
+	advanceDaemon(d, time.Second+hit/2)
+	metrics := serveDaemon(t, d, "/metrics")
+	assert.Contains(t, metrics, "deferred_hits_running 1\n")
+	assert.Contains(t, metrics, "deferred_hits_waiting 2\n")
+
+	advanceDaemon(d, hit)
+	assert.Equal(t, uint64(1), getStats(t, d, urlHigh).CounterLoops)
+	assert.Equal(t, uint64(0), getStats(t, d, urlMid).CounterLoops)
+	assert.Equal(t, uint64(0), getStats(t, d, urlLow).CounterLoops)
+
+	advanceDaemon(d, hit)
+	assert.Equal(t, uint64(1), getStats(t, d, urlMid).CounterLoops)
+	assert.Equal(t, uint64(0), getStats(t, d, urlLow).CounterLoops)
+
+	waitForDaemon(d)
+	assert.Equal(t, uint64(1), getStats(t, d, urlLow).CounterLoops)
+}
+
+func TestPriorityLimit(t *testing.T) {
+	d := testInit(
+		runner.MockedHit{HasEnqueue: true, Enqueue: 30},
+		runner.MockedHit{HasEnqueue: true, Enqueue: 30},
+	)
+	d.SetSecret("s3cr3t")
+	d.targetPriorities, _ = parseTargetPriorities("priority-limit-paying=10")
+	getPriority := func(target string) int {
+		for {
+			items, _ := d.store.GetQueued()
+			for _, item := range items {
+				if item.URL == target {
+					return item.Priority
+				}
+			}
+			runtime.Gosched()
+		}
+	}
+
+	// targets cannot raise their priority above the policy
+	for target, expected := range map[string]int{"priority-limit-free": 0, "priority-limit-paying": 10} {
+		query := url.Values{}
+		query.Set("target", target)
+		query.Set("hash", internal.GetMD5(target, "s3cr3t"))
+		query.Set("delay", "10")
+		query.Set("priority", "1000000")
+		w := httptest.NewRecorder()
+		d.handler()(w, httptest.NewRequest("GET", "/queue?"+query.Encode(), nil))
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Equal(t, expected, getPriority(target))
+	}
+
+	// the priority is kept when the target enqueues itself again
+	target := "priority-limit-lowered"
+	d.step1EnqueuePriority(target, 0, "", -3)
+	advanceDaemon(d, time.Second)
+	assert.Equal(t, uint64(1), getStats(t, d, target).CounterLoops)
+	assert.Equal(t, -3, getPriority(target))
+}
+
+func TestPriorityAging(t *testing.T) {
+	d := testInit()
+	d.priorityAging = time.Minute
+	d.targetPriorities, _ = parseTargetPriorities("https://a.com/=1 https://a.com/low=-1")
+
+	now := d.clock.Now()
+	due := []store.Item{
+		{URL: "https://b.com/", Time: now.Add(-90 * time.Second)},
+		{URL: "https://a.com/", Time: now},
+		{URL: "https://a.com/low", Time: now.Add(-time.Hour)},
+		{URL: "https://c.com/", Time: now, Priority: 2},
+	}
+	d.sortDue(due, now)
+
+	urls := make([]string, len(due))
+	for i, item := range due {
+		urls[i] = item.URL
+	}
+	assert.Equal(t, []string{"https://a.com/low", "https://c.com/", "https://b.com/", "https://a.com/"}, urls)
+
+	_, err := parseTargetPriorities("https://a.com/")
+	assert.NotNil(t, err)
+	_, err = parseTargetPriorities("https://a.com/=high")
+	assert.NotNil(t, err)
+}
+
 func TestEnqueueNegative(t *testing.T) {
 	d := testInit(runner.MockedHit{})
 	url := "enqueue-negative"
@@ -116,7 +378,7 @@ func TestEnqueueDuringHit(t *testing.T) {
 	url := "enqueue-during-hit"
 
 	d.enqueueNow(url)
-	time.Sleep(time.Second + hit/2)
+	advanceDaemon(d, time.Second+hit/2)
 
 	d.enqueueNow(url)
 	waitForDaemon(d)
@@ -135,17 +397,20 @@ func TestEnqueueZeroThirtyZero(t *testing.T) {
 
 	// this pattern mimics real world usage
 	d.enqueueNow(url)
-	time.Sleep(hit / 4)
+	advanceDaemon(d, hit/4)
 
 	d.enqueueSeconds(url, 3)
-	time.Sleep(hit / 2)
+	advanceDaemon(d, hit/2)
 
 	d.enqueueNow(url)
 	waitForDaemon(d)
 
 	stats := getStats(t, d, url)
 	assert.Equal(t, uint64(3), stats.CounterEnqueues)
-	assert.Equal(t, uint64(3), stats.CounterWakeUps)
+
+	// the timer for job2 is replaced by the one for job3 so the last wake up
+	// finds no timer and re-checks the queue until the cut off
+	assert.Equal(t, uint64(4), stats.CounterWakeUps)
 
 	/*
 		To understand loops value of 2, consider these job queues:
@@ -177,13 +442,15 @@ func TestReenqueueFromHit(t *testing.T) {
 }
 
 func TestAutoEnqueueOnMaxHits(t *testing.T) {
+	// hits need to take some time for the re-enqueue to be after the first loop
+	hit := time.Millisecond
 	hits := []runner.MockedHit{
-		runner.MockedHit{MoreDeferred: true},
-		runner.MockedHit{MoreDeferred: true},
-		runner.MockedHit{MoreDeferred: true},
+		runner.MockedHit{Duration: hit, MoreDeferred: true},
+		runner.MockedHit{Duration: hit, MoreDeferred: true},
+		runner.MockedHit{Duration: hit, MoreDeferred: true},
 		runner.MockedHit{},
 	}
-	runner := runner.NewMocked(hits, 3)
+	runner := runner.NewMockedWithClock(hits, 3, clock.NewTestFake())
 	d := &daemon{}
 	d.init(runner, nil)
 	configDaemon(d)
@@ -225,7 +492,7 @@ func TestMultiTwoOneAfterAnother(t *testing.T) {
 	url2 := "multi-two-one-after-another-2"
 
 	d.enqueueNow(url1)
-	time.Sleep(time.Second)
+	advanceDaemon(d, time.Second)
 
 	d.enqueueNow(url2)
 	waitForDaemon(d)
@@ -247,7 +514,7 @@ func TestMultiOneDuringAnother(t *testing.T) {
 	url2 := "multi-two-one-during-another-2"
 
 	d.enqueueNow(url1)
-	time.Sleep(time.Second + hit/2)
+	advanceDaemon(d, time.Second+hit/2)
 
 	d.enqueueNow(url2)
 	waitForDaemon(d)
@@ -259,24 +526,727 @@ func TestMultiOneDuringAnother(t *testing.T) {
 	assert.Equal(t, uint64(1), stats2.CounterLoops)
 }
 
+func TestMultiScripted(t *testing.T) {
+	url1 := "multi-scripted-1"
+	url2 := "multi-scripted-2"
+	enqueue := int64(60)
+	r := runner.NewScripted(&runner.Scenario{
+		Targets: map[string]*runner.Script{
+			url1: &runner.Script{Hits: []runner.ScriptedHit{
+				runner.ScriptedHit{MoreDeferred: true, Times: 2},
+				runner.ScriptedHit{},
+			}},
+			url2: &runner.Script{Hits: []runner.ScriptedHit{
+				runner.ScriptedHit{Enqueue: &enqueue},
+				runner.ScriptedHit{Error: runner.ScriptedErrorTimeout, Times: 2},
+			}},
+		},
+	}, clock.NewTestFake())
+	d := &daemon{}
+	d.init(r, nil)
+	configDaemon(d)
+
+	d.enqueueNow(url1)
+	d.enqueueNow(url2)
+	waitForDaemon(d)
+
+	stats1 := getStats(t, d, url1)
+	assert.Equal(t, uint64(3), stats1.CounterLoops)
+	assert.Equal(t, uint64(0), stats1.CounterErrors)
+
+	stats2 := getStats(t, d, url2)
+	assert.Equal(t, uint64(2), stats2.CounterEnqueues)
+	// failed target is retried until its queued time is cut off
+	assert.Equal(t, uint64(3), stats2.CounterLoops)
+	assert.Equal(t, uint64(2), stats2.CounterErrors)
+	assert.Equal(t, 6, len(r.Calls()))
+}
+
+func TestEndToEnd(t *testing.T) {
+	s := testserver.New(3)
+	defer s.Close()
+	s.SetConfig(testserver.Config{ProtocolVersion: internal.GetProtocolVersion()})
+	target := s.GetDeferredURL()
+
+	d := &daemon{}
+	d.init(runner.New(nil, nil), nil)
+	configDaemon(d)
+	d.SetSecret("s3cr3t")
+	h := httptest.NewServer(d.handler())
+	defer h.Close()
+
+	query := url.Values{}
+	query.Set("target", target)
+	query.Set("hash", "wrong")
+	resp, err := http.Get(h.URL + "/queue?" + query.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp.Body.Close()
+
+	query.Set("hash", internal.GetMD5(target, "s3cr3t"))
+	resp, err = http.Get(h.URL + "/queue?" + query.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	resp.Body.Close()
+
+	// the daemon uses real time here so we have to poll
+	var stats Stats
+	for i := 0; i < 100 && stats.CounterLoops < 3; i++ {
+		time.Sleep(time.Second / 100)
+
+		stats, _ = d.store.GetStats(target)
+	}
+
+	assert.Equal(t, uint64(3), stats.CounterLoops)
+	assert.Equal(t, internal.GetProtocolVersion(), stats.ProtocolVersion)
+	assert.Equal(t, 0, s.GetPendingJobs())
+	assert.Equal(t, 3, len(s.GetRequests()))
+}
+
+func TestQueueRequestID(t *testing.T) {
+	d := testInit(runner.MockedHit{})
+	d.SetSecret("s3cr3t")
+	h := httptest.NewServer(d.handler())
+	defer h.Close()
+	target := "queue-request-id"
+
+	query := url.Values{}
+	query.Set("target", target)
+	query.Set("hash", internal.GetMD5(target, "s3cr3t"))
+	req, _ := http.NewRequest("GET", h.URL+"/queue?"+query.Encode(), nil)
+	req.Header.Set(internal.GetRequestIDHeaderKey(), "from-add-on")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "from-add-on", resp.Header.Get(internal.GetRequestIDHeaderKey()))
+
+	for {
+		if items, _ := d.store.GetQueued(); len(items) > 0 {
+			assert.Equal(t, "from-add-on", items[0].RequestID)
+			break
+		}
+		runtime.Gosched()
+	}
+	waitForDaemon(d)
+
+	stats := getStats(t, d, target)
+	assert.Equal(t, uint64(1), stats.CounterLoops)
+}
+
+func TestQueueRateLimit(t *testing.T) {
+	d := testInit()
+	d.SetSecret("s3cr3t")
+	d.queueLimitIP = newRateLimiter(10, 4)
+	d.queueLimitTarget = newRateLimiter(1, 2)
+	c := d.clock.(*clock.Fake)
+
+	queue := func(remoteAddr string, target string) *httptest.ResponseRecorder {
+		query := url.Values{}
+		query.Set("target", target)
+		query.Set("hash", internal.GetMD5(target, "s3cr3t"))
+		r := httptest.NewRequest("GET", "/queue?"+query.Encode(), nil)
+		r.RemoteAddr = remoteAddr
+
+		w := httptest.NewRecorder()
+		d.handler()(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusAccepted, queue("1.2.3.4:1000", "a").Code)
+	assert.Equal(t, http.StatusAccepted, queue("1.2.3.4:1001", "a").Code)
+	w := queue("1.2.3.4:1002", "a")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	// the rejected request above still used a token of the client
+	assert.Equal(t, http.StatusAccepted, queue("1.2.3.4:1003", "b").Code)
+	assert.Equal(t, http.StatusTooManyRequests, queue("1.2.3.4:1004", "b").Code)
+	assert.Equal(t, http.StatusAccepted, queue("5.6.7.8:1000", "b").Code)
+
+	c.Advance(time.Second)
+	assert.Equal(t, http.StatusAccepted, queue("1.2.3.4:1005", "a").Code)
+
+	// socket clients are not limited by address
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusAccepted, queue("@", fmt.Sprintf("socket-%d", i)).Code)
+	}
+	waitForDaemon(d)
+
+	stats := make(map[string]statsResponse)
+	assert.Nil(t, json.Unmarshal([]byte(serveDaemon(t, d, "/stats")), &stats))
+	assert.Equal(t, uint64(1), stats["a"].CounterRejects)
+	assert.Equal(t, uint64(0), stats["b"].CounterRejects)
+
+	metrics := serveDaemon(t, d, "/metrics")
+	assert.True(t, strings.Contains(metrics, `deferred_queue_rejected_total{limit="ip"} 1`))
+	assert.True(t, strings.Contains(metrics, `deferred_queue_rejected_total{limit="target"} 1`))
+}
+
+func TestClusterHitOnce(t *testing.T) {
+	c := clock.NewTestFake()
+	s := store.NewMemory()
+	scenario := &runner.Scenario{
+		Targets: map[string]*runner.Script{
+			"*": &runner.Script{Hits: []runner.ScriptedHit{
+				runner.ScriptedHit{Latency: runner.ScriptedLatency{Min: runner.ScriptedDuration(time.Second)}},
+			}},
+		},
+	}
+	url := "cluster-hit-once"
+
+	var ds []*daemon
+	var rs []runner.ScriptedRunner
+	for i := 0; i < 3; i++ {
+		r := runner.NewScripted(scenario, c)
+		d := &daemon{}
+		d.init(r, nil)
+		configDaemon(d)
+		d.SetStore(s)
+
+		ds = append(ds, d)
+		rs = append(rs, r)
+	}
+
+	for _, d := range ds {
+		d.enqueueNow(url)
+	}
+	waitForDaemon(ds...)
+
+	calls := 0
+	for _, r := range rs {
+		calls += len(r.Calls())
+	}
+	assert.Equal(t, 1, calls)
+
+	stats, _ := s.GetStats(url)
+	assert.Equal(t, uint64(1), stats.CounterLoops)
+	assert.Equal(t, uint64(0), stats.CounterErrors)
+}
+
+func TestClusterFailOver(t *testing.T) {
+	c := clock.NewTestFake()
+	s := store.NewMemory()
+	url := "cluster-fail-over"
+
+	d2 := &daemon{}
+	d2.init(runner.NewMockedWithClock([]runner.MockedHit{runner.MockedHit{}}, 0, c), nil)
+	configDaemon(d2)
+	d2.defaultSchedule = 5 * time.Second
+	d2.SetStore(s)
+
+	// the first daemon accepts the enqueue but never wakes up, as if it has died
+	d1 := &daemon{}
+	d1.init(runner.NewMockedWithClock(nil, 0, c), nil)
+	d1.SetStore(s)
+	d1.wakeUpSignal <- 0
+	d1.enqueueSeconds(url, 1)
+
+	advanceDaemon(d2, 10*time.Second)
+
+	stats, _ := s.GetStats(url)
+	assert.Equal(t, uint64(1), stats.CounterLoops)
+	assert.True(t, stats.CounterWakeUps > 0)
+
+	d2.wakeUpSignal <- 0
+}
+
+func TestStoreRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "daemon")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.log")
+	url := "store-restart"
+
+	// the first daemon accepts the enqueue then stops before its wake up
+	s1, err := store.NewFile(path)
+	assert.Nil(t, err)
+	d1 := testInit()
+	d1.SetStore(s1)
+	d1.wakeUpSignal <- 0
+	d1.enqueueSeconds(url, 5)
+
+	s2, err := store.NewFile(path)
+	assert.Nil(t, err)
+	d2 := testInit(runner.MockedHit{})
+	d2.SetStore(s2)
+
+	advanceDaemon(d2, time.Minute)
+	assert.Equal(t, uint64(1), getStats(t, d2, url).CounterLoops)
+
+	d2.wakeUpSignal <- 0
+}
+
+type alertRecorder struct {
+	mutex sync.Mutex
+	kinds []alert.Kind
+}
+
+func (r *alertRecorder) Send(e alert.Event) error {
+	r.mutex.Lock()
+	r.kinds = append(r.kinds, e.Kind)
+	r.mutex.Unlock()
+	return nil
+}
+
+func (r *alertRecorder) getKinds() []alert.Kind {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]alert.Kind{}, r.kinds...)
+}
+
+func TestAlerts(t *testing.T) {
+	url := "alerts"
+	r := runner.NewScripted(&runner.Scenario{
+		Targets: map[string]*runner.Script{
+			url: &runner.Script{Hits: []runner.ScriptedHit{
+				runner.ScriptedHit{},
+				runner.ScriptedHit{Error: runner.ScriptedErrorStatus, Times: 2},
+				runner.ScriptedHit{},
+			}},
+		},
+	}, clock.NewTestFake())
+	d := &daemon{}
+	d.init(r, nil)
+	configDaemon(d)
+	d.alertCircuitOpen = 2
+
+	recorder := &alertRecorder{}
+	a := alert.New(d.clock, nil)
+	a.AddSink(recorder)
+	d.SetAlerter(a)
+
+	d.enqueueNow(url)
+	waitForDaemon(d)
+	assert.Equal(t, 0, len(recorder.getKinds()))
+
+	d.enqueueNow(url)
+	waitForDaemon(d)
+	d.enqueueNow(url)
+	waitForDaemon(d)
+
+	// alerts are sent in the background
+	for i := 0; i < 100 && len(recorder.getKinds()) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, []alert.Kind{alert.KindFirstFailure, alert.KindCircuitOpen, alert.KindRecovery}, recorder.getKinds())
+	assert.Equal(t, uint64(0), getStats(t, d, url).ConsecutiveErrors)
+}
+
+func TestStale(t *testing.T) {
+	d := testInit(runner.MockedHit{})
+	url := "stale"
+
+	d.trackQueue(url)
+	d.enqueueNow(url)
+	waitForDaemon(d)
+
+	advanceDaemon(d, d.staleAfter+time.Second)
+
+	body := serveDaemon(t, d, "/stats")
+	stats := make(map[string]statsResponse)
+	assert.Nil(t, json.Unmarshal([]byte(body), &stats))
+	assert.True(t, stats[url].Stale)
+	assert.Equal(t, uint64(1), stats[url].CounterLoops)
+
+	metrics := serveDaemon(t, d, "/metrics")
+	assert.True(t, strings.Contains(metrics, `deferred_target_stale{target="stale"} 1`))
+	assert.True(t, strings.Contains(metrics, `deferred_target_loops_total{target="stale"} 1`))
+}
+
+func TestStalePolling(t *testing.T) {
+	r := runner.NewScripted(&runner.Scenario{
+		Targets: map[string]*runner.Script{
+			"*": &runner.Script{Hits: []runner.ScriptedHit{runner.ScriptedHit{}}, Repeat: true},
+		},
+	}, clock.NewTestFake())
+	d := &daemon{}
+	d.init(r, nil)
+	configDaemon(d)
+	d.defaultSchedule = 10 * time.Second
+	d.staleAfter = time.Minute
+	d.stalePoll = true
+	url := "stale-polling"
+
+	d.trackQueue(url)
+	d.enqueueNow(url)
+	advanceDaemon(d, time.Minute)
+	stats := getStats(t, d, url)
+	assert.Equal(t, uint64(1), stats.CounterLoops)
+	assert.False(t, stats.Polling)
+
+	advanceDaemon(d, 30*time.Second)
+	stats = getStats(t, d, url)
+	assert.Equal(t, uint64(3), stats.CounterLoops)
+	assert.True(t, stats.Polling)
+	assert.False(t, d.isStale(stats, d.clock.Now()))
+
+	// polling continues on default schedule while the target is not calling /queue
+	advanceDaemon(d, 15*time.Second)
+	assert.Equal(t, uint64(5), getStats(t, d, url).CounterLoops)
+
+	d.trackQueue(url)
+	stats = getStats(t, d, url)
+	assert.False(t, stats.Polling)
+	assert.Equal(t, 105*time.Second, stats.Cadence)
+
+	// the last pending poll is still hit
+	advanceDaemon(d, 30*time.Second)
+	assert.Equal(t, uint64(6), getStats(t, d, url).CounterLoops)
+	advanceDaemon(d, time.Minute)
+	assert.Equal(t, uint64(6), getStats(t, d, url).CounterLoops)
+
+	d.wakeUpSignal <- 0
+}
+
+func TestReadAuth(t *testing.T) {
+	d := testInit()
+	d.secret = "s3cr3t"
+	url1 := "https://a.example.com/deferred.php"
+	url2 := "https://b.example.com/deferred.php"
+	d.enqueueSeconds(url1, 10)
+	d.enqueueSeconds(url2, 10)
+
+	read := func(uri string, setup func(*http.Request)) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", uri, nil)
+		if setup != nil {
+			setup(r)
+		}
+		d.handler()(w, r)
+		return w
+	}
+	queued := func(w *httptest.ResponseRecorder) map[string]float64 {
+		q := make(map[string]float64)
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &q))
+		return q
+	}
+
+	// without read auth, everything is public
+	assert.Contains(t, queued(read("/queued", nil)), url1)
+
+	d.readToken = "t0k3n"
+	d.readBasic = "user:pass"
+	d.readPrivate, _ = parseReadPrivate("/stats")
+
+	redacted := queued(read("/queued", nil))
+	assert.Equal(t, 2, len(redacted))
+	assert.NotContains(t, redacted, url1)
+	redactedName, _ := readAccess{secret: d.secret}.name(url1)
+	assert.Contains(t, redacted, redactedName)
+	assert.NotContains(t, redactedName, internal.GetMD5(url1, d.secret)[:12])
+	assert.NotContains(t, read("/metrics", nil).Body.String(), url1)
+
+	w := read("/stats", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, 2, len(w.Header()["Www-Authenticate"]))
+
+	w = read("/stats", func(r *http.Request) { r.Header.Set("Authorization", "Bearer t0k3n") })
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), url2)
+
+	w = read("/stats", func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") })
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = read("/queued", func(r *http.Request) { r.SetBasicAuth("user", "pass") })
+	assert.Contains(t, queued(w), url1)
+
+	signed := fmt.Sprintf("?target=%s&hash=%s", url.QueryEscape(url1), internal.GetMD5(url1, d.secret))
+	w = read("/stats"+signed, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), url1)
+	assert.NotContains(t, w.Body.String(), url2)
+	assert.Equal(t, map[string]float64{url1: 10}, queued(read("/queued"+signed, nil)))
+
+	_, err := parseReadPrivate("/queue")
+	assert.NotNil(t, err)
+}
+
+func TestHealth(t *testing.T) {
+	d := testInit(runner.MockedHit{})
+	d.defaultSchedule = 10 * time.Second
+	url := "health"
+
+	assert.Equal(t, "ok", serveDaemon(t, d, "/healthz"))
+
+	d.enqueueSeconds(url, 5)
+	ready := readyResponse{}
+	assert.Nil(t, json.Unmarshal([]byte(serveDaemon(t, d, "/readyz")), &ready))
+	assert.True(t, ready.Ready)
+
+	scheduler := schedulerResponse{}
+	assert.Nil(t, json.Unmarshal([]byte(serveDaemon(t, d, "/debug/scheduler")), &scheduler))
+	assert.Equal(t, 1, len(scheduler.Timers))
+	assert.Equal(t, float64(5), scheduler.Timers[0].Next)
+
+	advanceDaemon(d, time.Minute)
+	assert.Equal(t, uint64(1), getStats(t, d, url).CounterLoops)
+	assert.Nil(t, json.Unmarshal([]byte(serveDaemon(t, d, "/readyz")), &ready))
+	assert.True(t, ready.Ready)
+
+	// the wake up goroutine is gone, as if it has been wedged
+	d.wakeUpSignal <- 0
+	settleDaemon(d)
+	d.cutOff = time.Minute
+	d.enqueueSeconds(url, 5)
+	d.clock.(*clock.Fake).Advance(40 * time.Second)
+
+	w := httptest.NewRecorder()
+	d.handler()(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &ready))
+	assert.False(t, ready.Ready)
+	assert.Equal(t, "ok", ready.Checks["store"])
+	assert.NotEqual(t, "ok", ready.Checks["scheduler"])
+	assert.NotEqual(t, "ok", ready.Checks["timers"])
+}
+
+func TestHealthIdle(t *testing.T) {
+	d := testInit()
+	d.defaultSchedule = 10 * time.Second
+
+	d.clock.(*clock.Fake).Advance(time.Minute)
+	w := httptest.NewRecorder()
+	d.handler()(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestHealthRestart(t *testing.T) {
+	c := clock.NewTestFake()
+	s := store.NewMemory()
+	url1 := "health-restart-due"
+	url2 := "health-restart-later"
+	s.Enqueue(store.Item{URL: url1, Time: c.Now().Add(-time.Minute)}, c.Now())
+	s.Enqueue(store.Item{URL: url2, Time: c.Now().Add(time.Hour)}, c.Now())
+
+	// a restarted daemon must wake up for the persisted queue without any enqueue
+	d := &daemon{}
+	d.init(runner.NewMockedWithClock([]runner.MockedHit{runner.MockedHit{}}, 0, c), nil)
+	configDaemon(d)
+	d.defaultSchedule = 10 * time.Second
+	d.SetStore(s)
+
+	advanceDaemon(d, time.Minute)
+	assert.Equal(t, uint64(1), getStats(t, d, url1).CounterLoops)
+
+	w := httptest.NewRecorder()
+	d.handler()(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	d.wakeUpSignal <- 0
+}
+
+func TestListenSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "daemon")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "defermon.sock")
+
+	d := testInit()
+	go d.Listen(ListenConfig{Socket: socket})
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) { return net.Dial("unix", socket) },
+	}}
+	resp := getUntilListening(t, client, "http://defermon/healthz")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestListenTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "daemon")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, 1)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	socket := filepath.Join(dir, "defermon.sock")
+
+	d := testInit()
+	go d.Listen(ListenConfig{Address: addr, Socket: socket, CertFile: certFile, KeyFile: keyFile})
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp := getUntilListening(t, client, "https://"+addr+"/healthz")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(1), resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "h2", conn.ConnectionState().NegotiatedProtocol)
+	conn.Close()
+
+	// the socket is served without TLS
+	socketClient := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) { return net.Dial("unix", socket) },
+	}}
+	resp = getUntilListening(t, socketClient, "http://defermon/healthz")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "daemon")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, 1)
+
+	r := &certReloader{certFile: certFile, keyFile: keyFile, logger: internal.GetLogger()}
+	cert, err := r.reload()
+	assert.Nil(t, err)
+	assert.NotNil(t, cert)
+
+	cert, err = r.reload()
+	assert.Nil(t, err)
+	assert.Nil(t, cert)
+
+	writeTestCert(t, certFile, keyFile, 2)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	r.checkedAt = time.Time{}
+	cert, err = r.getCertificate(nil)
+	assert.Nil(t, err)
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	assert.Equal(t, int64(2), leaf.SerialNumber.Int64())
+
+	// a broken pair keeps the previous certificate
+	ioutil.WriteFile(keyFile, []byte("broken"), 0600)
+	future = future.Add(time.Minute)
+	os.Chtimes(keyFile, future, future)
+	r.checkedAt = time.Time{}
+	cert, err = r.getCertificate(nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, cert)
+}
+
+func advanceDaemon(d *daemon, duration time.Duration) {
+	c := d.clock.(*clock.Fake)
+	until := c.Now().Add(duration)
+
+	for {
+		settleDaemon(d)
+
+		next, ok := c.Next()
+		if !ok || next.After(until) {
+			c.Advance(until.Sub(c.Now()))
+			settleDaemon(d)
+			return
+		}
+
+		c.Advance(next.Sub(c.Now()))
+	}
+}
+
 func configDaemon(d *daemon) {
 	d.coolDown = time.Duration(time.Second / 4)
 	d.cutOff = time.Duration(3 * d.coolDown)
 	d.defaultSchedule = 0
+	d.scheduleCoalesceWindow = 0
+}
+
+func getUntilListening(t *testing.T, client *http.Client, url string) *http.Response {
+	for i := 0; ; i++ {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			return resp
+		}
+		if i > 100 {
+			t.Fatal(err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
 }
 
-func getStats(t *testing.T, d *daemon, url string) *Stats {
-	d.statsMutex.Lock()
-	stats, _ := d.stats[url]
-	d.statsMutex.Unlock()
+func getStats(t *testing.T, d *daemon, url string) Stats {
+	all, err := d.store.GetStatsAll()
+	assert.Nil(t, err)
 
-	assert.NotNil(t, stats)
+	stats, ok := all[url]
+	assert.True(t, ok)
 
 	return stats
 }
 
+func isDaemonSettled(d *daemon) (int64, bool) {
+	c := d.clock.(*clock.Fake)
+
+	d.wakeUpMutex.Lock()
+	running := d.wakeUpCounterStart != d.wakeUpCounterFinish
+	d.wakeUpMutex.Unlock()
+
+	if running {
+		// a wake up is settled when all of its hits are sleeping
+		// or, after the hits, it is cooling down
+		hitsRunning := atomic.LoadInt64(&d.hitsRunning)
+		if hitsRunning > 0 {
+			return hitsRunning, true
+		}
+
+		return 1, true
+	}
+
+	now := c.Now()
+	d.scheduleMutex.Lock()
+	coalescing := d.schedulesRunning > 0 && !d.schedulePendingAt.After(now)
+	d.scheduleMutex.Unlock()
+	if coalescing {
+		// the coalesce window has passed but its schedule has not finished yet
+		return 0, false
+	}
+
+	settled := true
+	d.timers.Range(func(key, value interface{}) bool {
+		if t, ok := value.(time.Time); ok && !t.After(now) {
+			// this timer has fired but its wake up has not started yet
+			settled = false
+			return false
+		}
+
+		return true
+	})
+
+	return 0, settled
+}
+
+func serveDaemon(t *testing.T, d *daemon, uri string) string {
+	w := httptest.NewRecorder()
+	d.handler()(w, httptest.NewRequest("GET", uri, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	body, _ := ioutil.ReadAll(w.Body)
+	return string(body)
+}
+
+func settleDaemon(ds ...*daemon) {
+	c := ds[0].clock.(*clock.Fake)
+
+	for {
+		expectedSleepers := int64(0)
+		settled := true
+		for _, d := range ds {
+			sleepers, ok := isDaemonSettled(d)
+			expectedSleepers += sleepers
+			settled = settled && ok
+		}
+
+		if settled && int64(c.Sleepers()) == expectedSleepers {
+			return
+		}
+
+		runtime.Gosched()
+	}
+}
+
 func testInit(hits ...runner.MockedHit) *daemon {
-	runner := runner.NewMocked(hits, 0)
+	runner := runner.NewMockedWithClock(hits, 0, clock.NewTestFake())
 
 	d := &daemon{}
 	d.init(runner, nil)
@@ -286,26 +1256,38 @@ func testInit(hits ...runner.MockedHit) *daemon {
 	return d
 }
 
-func waitForDaemon(d *daemon) {
-	quit := false
+func writeTestCert(t *testing.T, certFile string, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotAfter:     time.Now().Add(time.Hour),
+		NotBefore:    time.Now().Add(-time.Hour),
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+func waitForDaemon(ds ...*daemon) {
+	c := ds[0].clock.(*clock.Fake)
 
 	for {
-		d.wakeUpMutex.Lock()
-		wakeUpCounterStart := d.wakeUpCounterStart
-		wakeUpCounterFinish := d.wakeUpCounterFinish
-		d.wakeUpMutex.Unlock()
-
-		if wakeUpCounterFinish == wakeUpCounterStart &&
-			!d.hasTimers() {
-			if !quit {
-				quit = true
-			} else {
-				return
-			}
-		} else {
-			quit = false
+		settleDaemon(ds...)
+
+		next, ok := c.Next()
+		if !ok {
+			return
 		}
 
-		<-time.After(time.Second / 10)
+		c.Advance(next.Sub(c.Now()))
 	}
 }
@@ -1,17 +1,32 @@
 package daemon // import "github.com/daohoangson/go-deferred/pkg/daemon"
-import "time"
+import (
+	"github.com/daohoangson/go-deferred/pkg/alert"
+	"github.com/daohoangson/go-deferred/pkg/store"
+)
 
 // Daemon represents a server that can hit deferred.php targets
 type Daemon interface {
+	Listen(ListenConfig) error
 	ListenAndServe(uint64) error
+	SetAlerter(alert.Alerter)
 	SetSecret(string)
+	SetStore(store.Store)
 }
 
-// Stats represents metrics for an URL
-type Stats struct {
-	CounterEnqueues uint64    `json:"counter_enqueues"`
-	CounterErrors   uint64    `json:"counter_errors"`
-	CounterLoops    uint64    `json:"counter_loops"`
-	CounterWakeUps  uint64    `json:"counter_on_timers"`
-	LastHit         time.Time `json:"last_hit"`
+// ListenConfig represents where and how a daemon accepts requests
+type ListenConfig struct {
+	// Address is host:port, leave the host empty to bind all interfaces
+	Address string
+
+	// Socket is the path of a Unix domain socket, it can be used together with Address
+	Socket string
+
+	// CertFile and KeyFile enable HTTPS, they are reloaded when changed on disk
+	CertFile string
+	KeyFile  string
+
+	DisableHTTP2 bool
 }
+
+// Stats represents metrics for an URL
+type Stats = store.Stats
@@ -0,0 +1,186 @@
+package daemon // import "github.com/daohoangson/go-deferred/pkg/daemon"
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type readyResponse struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+type schedulerResponse struct {
+	NodeID          string  `json:"node_id"`
+	CoolDown        float64 `json:"cool_down"`
+	CutOff          float64 `json:"cut_off"`
+	DefaultSchedule float64 `json:"default_schedule"`
+	CoalesceWindow  float64 `json:"coalesce_window"`
+	HitsMax         int     `json:"hits_max"`
+	PriorityAging   float64 `json:"priority_aging"`
+
+	HitsRunning         int64           `json:"hits_running"`
+	HitsWaiting         int64           `json:"hits_waiting"`
+	SchedulesCoalesced  uint64          `json:"schedules_coalesced"`
+	SchedulePendingAt   time.Time       `json:"schedule_pending_at"`
+	TimerCounter        uint64          `json:"timer_counter"`
+	Timers              []timerResponse `json:"timers"`
+	TimersCancelled     uint64          `json:"timers_cancelled"`
+	TimersScheduled     uint64          `json:"timers_scheduled"`
+	WakeUpCounterStart  uint64          `json:"wake_up_counter_start"`
+	WakeUpCounterFinish uint64          `json:"wake_up_counter_finish"`
+	WakeUpStartedAt     time.Time       `json:"wake_up_started_at"`
+	WakeUpFinishedAt    time.Time       `json:"wake_up_finished_at"`
+}
+
+type timerResponse struct {
+	Counter uint64  `json:"counter"`
+	Next    float64 `json:"next"`
+}
+
+const checkOK = "ok"
+
+func (d *daemon) checkScheduler(now time.Time) string {
+	d.wakeUpMutex.Lock()
+	running := d.wakeUpCounterStart != d.wakeUpCounterFinish
+	startedAt := d.wakeUpStartedAt
+	finishedAt := d.wakeUpFinishedAt
+	d.wakeUpMutex.Unlock()
+
+	if running {
+		// a wake up lasts as long as its slowest loop, which is bounded by the lock
+		if elapsed := now.Sub(startedAt); elapsed > d.lockTTL {
+			return fmt.Sprintf("wake up has been running for %s", elapsed)
+		}
+
+		return checkOK
+	}
+
+	if d.defaultSchedule > 0 {
+		if idle := now.Sub(finishedAt); idle > 3*d.defaultSchedule {
+			// without queued items, the scheduler has no reason to wake up
+			if items, err := d.store.GetQueued(); err == nil && len(items) == 0 {
+				return checkOK
+			}
+
+			return fmt.Sprintf("no wake up for %s", idle)
+		}
+	}
+
+	return checkOK
+}
+
+func (d *daemon) checkTimers(now time.Time) string {
+	next, ok, err := d.store.GetNext(now.Add(-d.cutOff))
+	if err != nil || !ok {
+		// store errors are reported by their own check
+		return checkOK
+	}
+
+	// an item may be overdue briefly while its timer is firing or the wake up is cooling down
+	if next.Add(d.coolDown + 5*time.Second).After(now) {
+		return checkOK
+	}
+
+	d.wakeUpMutex.Lock()
+	running := d.wakeUpCounterStart != d.wakeUpCounterFinish
+	d.wakeUpMutex.Unlock()
+	if running {
+		return checkOK
+	}
+
+	return fmt.Sprintf("queued item is overdue by %s without a wake up", now.Sub(next))
+}
+
+func (d *daemon) serveDebugScheduler(w http.ResponseWriter, u *url.URL) (int, error) {
+	now := d.clock.Now()
+	resp := schedulerResponse{
+		NodeID:          d.nodeID,
+		CoolDown:        d.coolDown.Seconds(),
+		CutOff:          d.cutOff.Seconds(),
+		DefaultSchedule: d.defaultSchedule.Seconds(),
+		CoalesceWindow:  d.scheduleCoalesceWindow.Seconds(),
+		HitsMax:         d.hitsMax,
+		PriorityAging:   d.priorityAging.Seconds(),
+
+		HitsRunning:        atomic.LoadInt64(&d.hitsRunning),
+		HitsWaiting:        atomic.LoadInt64(&d.hitsWaiting),
+		SchedulesCoalesced: atomic.LoadUint64(&d.counterSchedulesCoalesced),
+		TimerCounter:       atomic.LoadUint64(&d.timerCounter),
+		Timers:             []timerResponse{},
+		TimersCancelled:    atomic.LoadUint64(&d.counterTimersCancelled),
+		TimersScheduled:    atomic.LoadUint64(&d.counterTimersScheduled),
+	}
+
+	d.scheduleMutex.Lock()
+	resp.SchedulePendingAt = d.schedulePendingAt
+	d.scheduleMutex.Unlock()
+
+	d.timers.Range(func(key, value interface{}) bool {
+		counter, _ := key.(uint64)
+		if t, ok := value.(time.Time); ok {
+			resp.Timers = append(resp.Timers, timerResponse{Counter: counter, Next: t.Sub(now).Seconds()})
+		}
+
+		return true
+	})
+	sort.Slice(resp.Timers, func(i, j int) bool { return resp.Timers[i].Counter < resp.Timers[j].Counter })
+
+	d.wakeUpMutex.Lock()
+	resp.WakeUpCounterStart = d.wakeUpCounterStart
+	resp.WakeUpCounterFinish = d.wakeUpCounterFinish
+	resp.WakeUpStartedAt = d.wakeUpStartedAt
+	resp.WakeUpFinishedAt = d.wakeUpFinishedAt
+	d.wakeUpMutex.Unlock()
+
+	json, err := json.Marshal(resp)
+	if err != nil {
+		return 0, err
+	}
+
+	w.Write(json)
+	return http.StatusOK, nil
+}
+
+func (d *daemon) serveHealthz(w http.ResponseWriter, u *url.URL) (int, error) {
+	w.Write([]byte(checkOK))
+	return http.StatusOK, nil
+}
+
+func (d *daemon) serveReadyz(w http.ResponseWriter, u *url.URL) (int, error) {
+	now := d.clock.Now()
+	resp := readyResponse{Ready: true, Checks: make(map[string]string)}
+
+	resp.Checks["store"] = checkOK
+	if _, _, err := d.store.GetNext(now); err != nil {
+		resp.Checks["store"] = err.Error()
+	}
+	resp.Checks["scheduler"] = d.checkScheduler(now)
+	resp.Checks["timers"] = d.checkTimers(now)
+
+	for _, check := range resp.Checks {
+		if check != checkOK {
+			resp.Ready = false
+		}
+	}
+
+	json, err := json.Marshal(resp)
+	if err != nil {
+		return 0, err
+	}
+
+	code := http.StatusOK
+	if !resp.Ready {
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(json)
+	return code, nil
+}
@@ -0,0 +1,119 @@
+package daemon // import "github.com/daohoangson/go-deferred/pkg/daemon"
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type rateLimiter struct {
+	burst float64
+	rate  float64
+
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// rateLimiterMaxBuckets triggers a sweep of full buckets, which are the same as missing ones
+const rateLimiterMaxBuckets = 10000
+
+// newRateLimiter returns a token bucket limiter per key, it returns nil if rate is not positive
+func newRateLimiter(rate float64, burst float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{burst: burst, rate: rate, buckets: make(map[string]*tokenBucket)}
+}
+
+// take returns zero if a token has been taken, or how long until the next one
+func (l *rateLimiter) take(key string, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= rateLimiterMaxBuckets {
+			l.sweep(now)
+		}
+
+		b = &tokenBucket{tokens: l.burst, updatedAt: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = l.refill(b, now)
+	b.updatedAt = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	elapsed := now.Sub(b.updatedAt).Seconds()
+	if elapsed <= 0 {
+		return b.tokens
+	}
+
+	return math.Min(l.burst, b.tokens+elapsed*l.rate)
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (d *daemon) rejectQueue(w http.ResponseWriter, target string, wait time.Duration, counter *uint64) (int, error) {
+	atomic.AddUint64(counter, 1)
+
+	if len(target) > 0 {
+		d.queueRejectsMutex.Lock()
+		if _, ok := d.queueRejects[target]; ok || len(d.queueRejects) < rateLimiterMaxBuckets {
+			d.queueRejects[target]++
+		}
+		d.queueRejectsMutex.Unlock()
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return http.StatusTooManyRequests, nil
+}
+
+// getClientIP returns the address of the client, or the first forwarded address if trusted,
+// it returns an empty string for Unix domain socket clients
+func getClientIP(r *http.Request, trustForwarded bool) string {
+	if trustForwarded {
+		if forwarded := r.Header.Get("X-Forwarded-For"); len(forwarded) > 0 {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// Unix domain socket clients have no address
+		return ""
+	}
+
+	return host
+}
@@ -0,0 +1,148 @@
+package daemon // import "github.com/daohoangson/go-deferred/pkg/daemon"
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   *logrus.Logger
+
+	mutex     sync.Mutex
+	cert      *tls.Certificate
+	checkedAt time.Time
+	modTimes  [2]time.Time
+}
+
+// certCheckInterval limits how often the cert and key files are checked for changes
+const certCheckInterval = 10 * time.Second
+
+func (d *daemon) Listen(config ListenConfig) error {
+	if len(config.Address) == 0 && len(config.Socket) == 0 {
+		return errors.New("No address or socket to listen on")
+	}
+
+	server := &http.Server{Handler: d.handler()}
+
+	if len(config.CertFile) > 0 || len(config.KeyFile) > 0 {
+		reloader := &certReloader{certFile: config.CertFile, keyFile: config.KeyFile, logger: d.logger}
+		if _, err := reloader.reload(); err != nil {
+			return err
+		}
+
+		server.TLSConfig = &tls.Config{GetCertificate: reloader.getCertificate}
+		if !config.DisableHTTP2 {
+			server.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+	}
+	if config.DisableHTTP2 {
+		// a non-nil empty map turns off the automatic HTTP/2 support
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	var listeners []net.Listener
+	var tlsListener net.Listener
+	if len(config.Address) > 0 {
+		l, err := net.Listen("tcp", config.Address)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, l)
+		tlsListener = l
+		d.logger.WithFields(logrus.Fields{
+			"addr": config.Address,
+			"tls":  server.TLSConfig != nil,
+		}).Warn("Going to listen and serve now...")
+	}
+
+	if len(config.Socket) > 0 {
+		// a stale socket from a previous run would fail the listen
+		if info, err := os.Stat(config.Socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(config.Socket)
+		}
+
+		l, err := net.Listen("unix", config.Socket)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
+		d.logger.WithField("socket", config.Socket).Warn("Going to listen and serve now...")
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			// local clients of the socket do not need TLS
+			if server.TLSConfig != nil && l == tlsListener {
+				errs <- server.ServeTLS(l, "", "")
+			} else {
+				errs <- server.Serve(l)
+			}
+		}(l)
+	}
+
+	err := <-errs
+	server.Close()
+	return err
+}
+
+func (r *certReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	cert := r.cert
+	due := time.Since(r.checkedAt) >= certCheckInterval
+	r.mutex.Unlock()
+
+	if !due {
+		return cert, nil
+	}
+
+	if reloaded, err := r.reload(); err != nil {
+		r.logger.WithError(err).Error("Could not reload certificate")
+	} else if reloaded != nil {
+		cert = reloaded
+	}
+
+	return cert, nil
+}
+
+// reload loads the cert and key files if they have changed, it returns nil if they have not
+func (r *certReloader) reload() (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.checkedAt = time.Now()
+
+	var modTimes [2]time.Time
+	for i, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	if r.cert != nil && modTimes == r.modTimes {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	r.cert = &cert
+	r.modTimes = modTimes
+	r.logger.WithField("cert", r.certFile).Info("Loaded certificate")
+
+	return r.cert, nil
+}
@@ -0,0 +1,180 @@
+package daemon // import "github.com/daohoangson/go-deferred/pkg/daemon"
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/daohoangson/go-deferred/pkg/store"
+)
+
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	value func(Stats, bool) float64
+}
+
+var targetMetrics = []metric{
+	{"deferred_target_enqueues_total", "Enqueues of the target.", "counter", func(s Stats, _ bool) float64 { return float64(s.CounterEnqueues) }},
+	{"deferred_target_errors_total", "Failed loops of the target.", "counter", func(s Stats, _ bool) float64 { return float64(s.CounterErrors) }},
+	{"deferred_target_loops_total", "Hits of the target.", "counter", func(s Stats, _ bool) float64 { return float64(s.CounterLoops) }},
+	{"deferred_target_wake_ups_total", "Wake ups for the target.", "counter", func(s Stats, _ bool) float64 { return float64(s.CounterWakeUps) }},
+	{"deferred_target_consecutive_errors", "Failed loops of the target since its last success.", "gauge", func(s Stats, _ bool) float64 { return float64(s.ConsecutiveErrors) }},
+	{"deferred_target_last_hit_timestamp_seconds", "Time of the last successful hit.", "gauge", func(s Stats, _ bool) float64 { return unixSeconds(s.LastHit) }},
+	{"deferred_target_last_queued_timestamp_seconds", "Time of the last /queue request from the target.", "gauge", func(s Stats, _ bool) float64 { return unixSeconds(s.LastQueued) }},
+	{"deferred_target_polling", "Whether the target is being polled because it is stale.", "gauge", func(s Stats, _ bool) float64 { return boolValue(s.Polling) }},
+	{"deferred_target_protocol_version", "Protocol version negotiated with the target, 0 if it advertised none.", "gauge", func(s Stats, _ bool) float64 { return protocolVersionValue(s.ProtocolVersion) }},
+	{"deferred_target_stale", "Whether the last successful hit of the target is older than expected.", "gauge", func(_ Stats, stale bool) float64 { return boolValue(stale) }},
+}
+
+func (d *daemon) serveMetrics(w http.ResponseWriter, u *url.URL, access readAccess) (int, error) {
+	stored, err := d.store.GetStatsAll()
+	if err != nil {
+		return 0, err
+	}
+
+	all := make(map[string]Stats, len(stored))
+	for url, stats := range stored {
+		if name, ok := access.name(url); ok {
+			all[name] = stats
+		}
+	}
+
+	urls := make([]string, 0, len(all))
+	for url := range all {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+
+	now := d.clock.Now()
+	stale := make(map[string]bool)
+	for _, url := range urls {
+		stale[url] = d.isStale(all[url], now)
+	}
+
+	var b bytes.Buffer
+	writeMetric(&b, "deferred_hits_running", "Hits that are running.", "gauge")
+	fmt.Fprintf(&b, "deferred_hits_running %d\n", atomic.LoadInt64(&d.hitsRunning))
+
+	writeMetric(&b, "deferred_hits_waiting", "Due hits waiting for a free worker.", "gauge")
+	fmt.Fprintf(&b, "deferred_hits_waiting %d\n", atomic.LoadInt64(&d.hitsWaiting))
+
+	writeMetric(&b, "deferred_queue_rejected_total", "Rejected /queue requests.", "counter")
+	fmt.Fprintf(&b, "deferred_queue_rejected_total{limit=\"ip\"} %d\n", atomic.LoadUint64(&d.queueRejectsByIP))
+	fmt.Fprintf(&b, "deferred_queue_rejected_total{limit=\"target\"} %d\n", atomic.LoadUint64(&d.queueRejectsByTarget))
+
+	writeMetric(&b, "deferred_schedule_coalesced_total", "Enqueues that joined a pending schedule.", "counter")
+	fmt.Fprintf(&b, "deferred_schedule_coalesced_total %d\n", atomic.LoadUint64(&d.counterSchedulesCoalesced))
+
+	writeMetric(&b, "deferred_timers_cancelled_total", "Pending timers replaced by an earlier one.", "counter")
+	fmt.Fprintf(&b, "deferred_timers_cancelled_total %d\n", atomic.LoadUint64(&d.counterTimersCancelled))
+
+	writeMetric(&b, "deferred_timers_scheduled_total", "Timers scheduled.", "counter")
+	fmt.Fprintf(&b, "deferred_timers_scheduled_total %d\n", atomic.LoadUint64(&d.counterTimersScheduled))
+
+	for _, m := range targetMetrics {
+		writeMetric(&b, m.name, m.help, m.kind)
+		for _, url := range urls {
+			fmt.Fprintf(&b, "%s{target=\"%s\"} %g\n", m.name, escapeLabel(url), m.value(all[url], stale[url]))
+		}
+	}
+
+	writeProgressMetrics(&b, urls, all)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+	return http.StatusOK, nil
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+
+	return 0
+}
+
+func writeProgressMetrics(b *bytes.Buffer, urls []string, all map[string]Stats) {
+	writeMetric(b, "deferred_target_jobs_total", "Jobs reported by the target.", "counter")
+	for _, url := range urls {
+		if p := all[url].Progress; p != nil {
+			fmt.Fprintf(b, "deferred_target_jobs_total{target=\"%s\"} %d\n", escapeLabel(url), p.CounterJobs)
+		}
+	}
+
+	writeMetric(b, "deferred_target_jobs_remaining", "Pending jobs reported by the target.", "gauge")
+	for _, url := range urls {
+		if p := all[url].Progress; p != nil && p.Remaining != nil {
+			fmt.Fprintf(b, "deferred_target_jobs_remaining{target=\"%s\"} %d\n", escapeLabel(url), *p.Remaining)
+		}
+	}
+
+	writeMetric(b, "deferred_target_job_runs_total", "Runs of each job reported by the target.", "counter")
+	for _, url := range urls {
+		forEachJob(all[url].Progress, func(name string, jobStats store.JobStats) {
+			fmt.Fprintf(b, "deferred_target_job_runs_total{target=\"%s\",job=\"%s\"} %d\n", escapeLabel(url), escapeLabel(name), jobStats.Count)
+		})
+	}
+
+	writeMetric(b, "deferred_target_job_duration_seconds_total", "Duration of each job reported by the target.", "counter")
+	for _, url := range urls {
+		forEachJob(all[url].Progress, func(name string, jobStats store.JobStats) {
+			fmt.Fprintf(b, "deferred_target_job_duration_seconds_total{target=\"%s\",job=\"%s\"} %g\n", escapeLabel(url), escapeLabel(name), jobStats.Duration.Seconds())
+		})
+	}
+
+	writeMetric(b, "deferred_target_current_job_percent", "Completion of the job that the target is running.", "gauge")
+	for _, url := range urls {
+		if p := all[url].Progress; p != nil && len(p.Current) > 0 {
+			fmt.Fprintf(b, "deferred_target_current_job_percent{target=\"%s\",job=\"%s\"} %g\n", escapeLabel(url), escapeLabel(p.Current), p.CurrentPercent)
+		}
+	}
+}
+
+func forEachJob(p *store.ProgressStats, f func(string, store.JobStats)) {
+	if p == nil {
+		return
+	}
+
+	names := make([]string, 0, len(p.Jobs))
+	for name := range p.Jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f(name, p.Jobs[name])
+	}
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(value)
+}
+
+func protocolVersionValue(version string) float64 {
+	value, err := strconv.ParseUint(version, 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return float64(value)
+}
+
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+func writeMetric(b *bytes.Buffer, name string, help string, kind string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
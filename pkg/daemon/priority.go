@@ -0,0 +1,100 @@
+package daemon // import "github.com/daohoangson/go-deferred/pkg/daemon"
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daohoangson/go-deferred/pkg/store"
+)
+
+type targetPriority struct {
+	prefix   string
+	priority int
+}
+
+// parseTargetPriorities parses space separated `prefix=priority` pairs
+func parseTargetPriorities(value string) ([]targetPriority, error) {
+	priorities := make([]targetPriority, 0)
+	for _, pair := range strings.Fields(value) {
+		i := strings.LastIndex(pair, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("%q is not prefix=priority", pair)
+		}
+
+		priority, err := strconv.Atoi(pair[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%q has invalid priority: %s", pair, err)
+		}
+
+		priorities = append(priorities, targetPriority{prefix: pair[:i], priority: priority})
+	}
+
+	// the longest prefix wins
+	sort.SliceStable(priorities, func(i, j int) bool {
+		return len(priorities[i].prefix) > len(priorities[j].prefix)
+	})
+
+	return priorities, nil
+}
+
+// getPolicyPriority returns the priority of the target from DEFERRED_TARGET_PRIORITIES
+func (d *daemon) getPolicyPriority(url string) int {
+	for _, p := range d.targetPriorities {
+		if strings.HasPrefix(url, p.prefix) {
+			return p.priority
+		}
+	}
+
+	return 0
+}
+
+// limitPriority caps a priority sent by the target at its policy priority,
+// targets may lower their priority but only the operator can raise it
+func (d *daemon) limitPriority(url string, priority int) int {
+	if policy := d.getPolicyPriority(url); priority > policy {
+		return policy
+	}
+
+	return priority
+}
+
+// getTargetPriority returns the priority of the item, falling back to the target policy
+func (d *daemon) getTargetPriority(item store.Item) int {
+	if item.Priority != 0 {
+		return item.Priority
+	}
+
+	return d.getPolicyPriority(item.URL)
+}
+
+// getEffectivePriority adds one point for each aging step the item has been due
+// so that low priority targets are not starved
+func (d *daemon) getEffectivePriority(item store.Item, now time.Time) float64 {
+	priority := float64(d.getTargetPriority(item))
+	if d.priorityAging > 0 && now.After(item.Time) {
+		priority += float64(now.Sub(item.Time)) / float64(d.priorityAging)
+	}
+
+	return priority
+}
+
+// sortDue orders the items by effective priority, the earliest first if tied
+func (d *daemon) sortDue(due []store.Item, now time.Time) {
+	priorities := make(map[string]float64, len(due))
+	for _, item := range due {
+		priorities[item.URL] = d.getEffectivePriority(item, now)
+	}
+
+	sort.SliceStable(due, func(i, j int) bool {
+		pi := priorities[due[i].URL]
+		pj := priorities[due[j].URL]
+		if pi != pj {
+			return pi > pj
+		}
+
+		return due[i].Time.Before(due[j].Time)
+	})
+}
@@ -0,0 +1,60 @@
+package daemon // import "github.com/daohoangson/go-deferred/pkg/daemon"
+
+import (
+	"time"
+
+	"github.com/daohoangson/go-deferred/pkg/runner"
+	"github.com/daohoangson/go-deferred/pkg/store"
+)
+
+// progressMaxJobNames limits the job names tracked per target, others are counted as progressOtherJobs
+const progressMaxJobNames = 100
+
+const progressOtherJobs = "other"
+
+// aggregateProgress returns a copy of prev updated with the progress of the hits, or nil if none has progress
+func aggregateProgress(prev *store.ProgressStats, hits runner.Hits, now time.Time) *store.ProgressStats {
+	var p *store.ProgressStats
+
+	for _, hit := range hits.List {
+		progress := hit.Data.Progress
+		if progress == nil {
+			continue
+		}
+
+		if p == nil {
+			p = &store.ProgressStats{Jobs: make(map[string]store.JobStats)}
+			if prev != nil {
+				p.CounterJobs = prev.CounterJobs
+				for name, jobStats := range prev.Jobs {
+					p.Jobs[name] = jobStats
+				}
+			}
+		}
+
+		p.CounterJobs += uint64(len(progress.Jobs))
+		for _, job := range progress.Jobs {
+			name := job.Name
+			if _, ok := p.Jobs[name]; !ok && len(p.Jobs) >= progressMaxJobNames {
+				name = progressOtherJobs
+			}
+
+			jobStats := p.Jobs[name]
+			jobStats.Count++
+			jobStats.Duration += time.Duration(job.Duration * float64(time.Second))
+			p.Jobs[name] = jobStats
+		}
+
+		// the latest hit tells the current state
+		p.Current = ""
+		p.CurrentPercent = 0
+		if progress.Current != nil {
+			p.Current = progress.Current.Name
+			p.CurrentPercent = progress.Current.Percent
+		}
+		p.Remaining = progress.Remaining
+		p.UpdatedAt = now
+	}
+
+	return p
+}
@@ -0,0 +1,115 @@
+package daemon // import "github.com/daohoangson/go-deferred/pkg/daemon"
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/daohoangson/go-deferred/internal"
+	"github.com/daohoangson/go-deferred/pkg/store"
+)
+
+type statsResponse struct {
+	Stats
+	Stale bool `json:"stale"`
+
+	// CounterRejects is the number of /queue requests rejected by this daemon since it started
+	CounterRejects uint64 `json:"counter_rejects"`
+}
+
+// isStale returns true if the last successful hit of a target is older than expected from its cadence
+func (d *daemon) isStale(stats Stats, now time.Time) bool {
+	if d.staleAfter <= 0 {
+		return false
+	}
+
+	last := stats.LastHit
+	if last.IsZero() {
+		last = stats.LastQueued
+	}
+	if last.IsZero() {
+		return false
+	}
+
+	threshold := d.staleAfter
+	if cadenceThreshold := stats.Cadence * time.Duration(d.staleCadenceFactor); cadenceThreshold > threshold {
+		threshold = cadenceThreshold
+	}
+
+	return now.Sub(last) > threshold
+}
+
+// pollStale enqueues stale targets on default schedule even though they stopped calling /queue
+func (d *daemon) pollStale(now time.Time) {
+	logger := d.logger.WithField(internal.LogFieldStep, "poll")
+
+	all, err := d.store.GetStatsAll()
+	if err != nil {
+		logger.WithError(err).Error("Could not get stats")
+		return
+	}
+
+	for url, stats := range all {
+		if stats.Stopped {
+			continue
+		}
+
+		if !stats.Polling {
+			if !d.isStale(stats, now) {
+				continue
+			}
+
+			if _, err := d.store.UpdateStats(url, func(stats *Stats) {
+				stats.Polling = true
+			}); err != nil {
+				logger.WithError(err).Error("Could not update stats")
+				continue
+			}
+
+			logger.WithFields(logrus.Fields{
+				internal.LogFieldTarget: url,
+				"last_hit":              stats.LastHit,
+			}).Warn("Stale, polling")
+		}
+
+		// an earlier pending item is kept, the next poll is due after the current one
+		if _, err := d.store.Enqueue(store.Item{URL: url, Time: now.Add(d.defaultSchedule)}, now); err != nil {
+			logger.WithError(err).Error("Could not store")
+		}
+	}
+}
+
+// trackQueue records a /queue request from the target, it also stops polling and resumes a stopped target
+func (d *daemon) trackQueue(url string) {
+	now := d.clock.Now()
+
+	if _, err := d.store.UpdateStats(url, func(stats *Stats) {
+		if !stats.LastQueued.IsZero() {
+			interval := now.Sub(stats.LastQueued)
+			if stats.Cadence == 0 {
+				stats.Cadence = interval
+			} else {
+				stats.Cadence = (stats.Cadence*7 + interval) / 8
+			}
+		}
+
+		stats.LastQueued = now
+		stats.Polling = false
+		stats.Stopped = false
+	}); err != nil {
+		d.logger.WithError(err).Error("Could not update stats")
+	}
+}
+
+// stopTarget removes the target from the queue and stops polling it, until it sends /queue again
+func (d *daemon) stopTarget(url string, logger *logrus.Entry) {
+	if err := d.store.Remove(url); err != nil {
+		logger.WithError(err).Error("Could not remove")
+	}
+
+	if _, err := d.store.UpdateStats(url, func(stats *Stats) {
+		stats.Polling = false
+		stats.Stopped = true
+	}); err != nil {
+		logger.WithError(err).Error("Could not update stats")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/daohoangson/go-deferred/pkg/clock"
 )
 
 // Data represents response from hit target
@@ -13,30 +14,166 @@ type Data struct {
 
 	// XenForo 2 job.php
 	More bool
+
+	// Progress is only kept for targets that negotiated progress reporting
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+// Progress represents the jobs of a target, as reported in its response
+type Progress struct {
+	// Remaining is the number of pending jobs, nil if the target did not count them
+	Remaining *uint64 `json:"remaining,omitempty"`
+
+	// Jobs are the ones that ran during the hit
+	Jobs []JobProgress `json:"jobs,omitempty"`
+
+	// Current is the job that will continue in the next hit
+	Current *JobProgress `json:"current,omitempty"`
+}
+
+// JobProgress represents a job reported by a target
+type JobProgress struct {
+	Name string `json:"name"`
+
+	// Duration is in seconds
+	Duration float64 `json:"duration,omitempty"`
+
+	// Percent is the completion of a current job, from 0 to 100
+	Percent float64 `json:"percent,omitempty"`
+}
+
+// EnqueueHint represents the enqueue header of a hit, only the delay is available without structured hints
+type EnqueueHint struct {
+	// At is the absolute time of the next hit, Delay is used if it is zero
+	At    time.Time     `json:"at"`
+	Delay time.Duration `json:"delay"`
+
+	// NotBefore and NotAfter limit the time of the next hit if they are not zero
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+
+	Priority int `json:"priority"`
+
+	// Stop means the target has no more work and should not be polled until it is queued again
+	Stop bool `json:"stop"`
 }
 
 // Hit represents a successful hit
 type Hit struct {
 	Data        Data
 	Enqueue     int64
+	EnqueueHint *EnqueueHint
 	HasEnqueue  bool
 	TimeStart   time.Time
 	TimeElapsed time.Duration
+
+	// ProtocolVersion is negotiated with the version advertised by target, empty if it advertised none
+	ProtocolVersion string
 }
 
 // Hits represents a series of hits (a loop)
 type Hits struct {
 	List        []Hit
+	StopReason  StopReason
 	TimeStart   time.Time
 	TimeElapsed time.Duration
+
+	// ProtocolVersion is the one of the last hit that reached target
+	ProtocolVersion string
+}
+
+// Configurable represents a Runner whose loop settings can be changed after it is created
+type Configurable interface {
+	SetCooldownDuration(time.Duration)
+	SetErrorsBeforeQuitting(uint64)
+	SetMaxHitsPerLoop(uint64)
+	SetMaxLoopDuration(time.Duration)
+	SetMinHitInterval(time.Duration)
+}
+
+// Failable represents a Runner that may not be usable after it is created,
+// e.g. when its cassette cannot be opened, all of its hits fail then
+type Failable interface {
+	GetInitError() error
+}
+
+// Flavour represents the XenForo entry point detected by a probe
+type Flavour string
+
+const (
+	// FlavourUnknown means the response has neither moreDeferred nor more
+	FlavourUnknown Flavour = ""
+	// FlavourXF1 means XenForo 1 deferred.php with moreDeferred
+	FlavourXF1 Flavour = "xf1"
+	// FlavourXF2 means XenForo 2 job.php with more
+	FlavourXF2 Flavour = "xf2"
+)
+
+// ProbeResult represents what a single hit found out about a target
+type ProbeResult struct {
+	URL         string        `json:"url"`
+	Valid       bool          `json:"valid"`
+	Problems    []string      `json:"problems,omitempty"`
+	StatusCode  int           `json:"status_code"`
+	ContentType string        `json:"content_type"`
+	Flavour     Flavour       `json:"flavour"`
+	Data        Data          `json:"data"`
+	Latency     time.Duration `json:"latency"`
+	Elapsed     time.Duration `json:"elapsed"`
+
+	// ProtocolVersion is the version header sent back by the target, empty if not supported
+	ProtocolVersion string       `json:"protocol_version,omitempty"`
+	Enqueue         *int64       `json:"enqueue,omitempty"`
+	EnqueueHint     *EnqueueHint `json:"enqueue_hint,omitempty"`
+
+	TLS *ProbeTLS `json:"tls,omitempty"`
+}
+
+// ProbeTLS represents the TLS connection to a target
+type ProbeTLS struct {
+	Version     string    `json:"version"`
+	CipherSuite string    `json:"cipher_suite"`
+	Protocol    string    `json:"protocol,omitempty"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	NotAfter    time.Time `json:"not_after"`
+	Verified    bool      `json:"verified"`
+	VerifyError string    `json:"verify_error,omitempty"`
 }
 
 // Runner represents an object that can hit deferred.php targets
 type Runner interface {
+	GetClock() clock.Clock
 	GetCooldownDuration() time.Duration
 	GetDumpResponseOnParseError() bool
 	GetErrorsBeforeQuitting() uint64
 	GetLogger() *logrus.Logger
 	GetMaxHitsPerLoop() uint64
+	GetMaxLoopDuration() time.Duration
+	GetMinHitInterval() time.Duration
 	Hit(url string) (Hit, error)
 }
+
+// requestHitter is implemented by runners that can add a request id to their hit log lines
+type requestHitter interface {
+	HitWithRequestID(url string, requestID string) (Hit, error)
+}
+
+// StopReason represents the condition that ended a loop
+type StopReason string
+
+const (
+	// StopReasonNoMore means target reported there is no more jobs
+	StopReasonNoMore StopReason = "no_more"
+	// StopReasonErrors means too many consecutive errors
+	StopReasonErrors StopReason = "errors"
+	// StopReasonMaxHits means the loop reached max hits per loop
+	StopReasonMaxHits StopReason = "max_hits"
+	// StopReasonMaxDuration means the loop ran out of its time budget
+	StopReasonMaxDuration StopReason = "max_duration"
+)
+
+// HasMore returns true if the loop was cut short while target still has jobs
+func (r StopReason) HasMore() bool {
+	return r == StopReasonMaxHits || r == StopReasonMaxDuration
+}
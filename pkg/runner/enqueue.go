@@ -0,0 +1,98 @@
+package runner // import "github.com/daohoangson/go-deferred/pkg/runner"
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseEnqueueHint parses the enqueue header, it is either a delay in seconds
+// or, if structured is true, pairs like "at=1529366400; priority=5" or "stop".
+// Unknown keys are ignored for newer targets.
+func ParseEnqueueHint(value string, structured bool) (*EnqueueHint, error) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return &EnqueueHint{Delay: time.Duration(seconds) * time.Second}, nil
+	}
+	if !structured {
+		return nil, fmt.Errorf("%q is not a number of seconds", value)
+	}
+
+	hint := &EnqueueHint{}
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		if part == "stop" {
+			hint.Stop = true
+			continue
+		}
+
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("%q is not a key=value pair", part)
+		}
+		key := strings.TrimSpace(pair[0])
+		switch key {
+		case "at", "delay", "not-after", "not-before", "priority":
+		default:
+			// the value of an unknown key may not be a number
+			continue
+		}
+
+		number, err := strconv.ParseInt(strings.TrimSpace(pair[1]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not an integer", key)
+		}
+
+		switch key {
+		case "at":
+			hint.At = time.Unix(number, 0)
+		case "delay":
+			hint.Delay = time.Duration(number) * time.Second
+		case "not-after":
+			hint.NotAfter = time.Unix(number, 0)
+		case "not-before":
+			hint.NotBefore = time.Unix(number, 0)
+		case "priority":
+			hint.Priority = int(number)
+		}
+	}
+
+	if !hint.NotBefore.IsZero() && !hint.NotAfter.IsZero() && hint.NotAfter.Before(hint.NotBefore) {
+		return nil, fmt.Errorf("not-after is before not-before")
+	}
+
+	return hint, nil
+}
+
+// Time returns when the next hit is due, relative delays start at now
+func (h EnqueueHint) Time(now time.Time) time.Time {
+	t := h.At
+	if t.IsZero() {
+		t = now.Add(h.Delay)
+	}
+
+	if !h.NotBefore.IsZero() && t.Before(h.NotBefore) {
+		t = h.NotBefore
+	}
+	if !h.NotAfter.IsZero() && t.After(h.NotAfter) {
+		t = h.NotAfter
+	}
+
+	return t
+}
+
+// setEnqueueHint also sets the delay in seconds for consumers of the plain enqueue header
+func (hit *Hit) setEnqueueHint(hint *EnqueueHint, now time.Time) {
+	hit.EnqueueHint = hint
+	if hint.Stop {
+		return
+	}
+
+	hit.HasEnqueue = true
+	hit.Enqueue = int64(math.Ceil(hint.Time(now).Sub(now).Seconds()))
+}
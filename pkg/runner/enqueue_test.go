@@ -0,0 +1,41 @@
+package runner // import "github.com/daohoangson/go-deferred/pkg/runner"
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEnqueueHint(t *testing.T) {
+	now := time.Unix(1529366400, 0)
+
+	hint, err := ParseEnqueueHint("30", false)
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(30*time.Second), hint.Time(now))
+
+	_, err = ParseEnqueueHint("delay=30", false)
+	assert.NotNil(t, err)
+
+	hint, err = ParseEnqueueHint("at=1529366500; priority=5; future=1; reason=idle", true)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Unix(1529366500, 0), hint.Time(now))
+	assert.Equal(t, 5, hint.Priority)
+
+	hint, err = ParseEnqueueHint("delay=30; not-before=1529366460", true)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Unix(1529366460, 0), hint.Time(now))
+
+	hint, err = ParseEnqueueHint("delay=300; not-after=1529366460", true)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Unix(1529366460, 0), hint.Time(now))
+
+	hint, err = ParseEnqueueHint("stop", true)
+	assert.Nil(t, err)
+	assert.True(t, hint.Stop)
+
+	for _, value := range []string{"soon", "delay=soon", "not-before=2; not-after=1"} {
+		_, err = ParseEnqueueHint(value, true)
+		assert.NotNil(t, err, value)
+	}
+}
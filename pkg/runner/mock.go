@@ -7,14 +7,18 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/daohoangson/go-deferred/internal"
+	"github.com/daohoangson/go-deferred/pkg/clock"
 )
 
 type mockedRunner struct {
+	clock     clock.Clock
 	hits      []MockedHit
 	hitsMutex sync.Mutex
 
 	errorsBeforeQuitting uint64
 	maxHitsPerLoop       uint64
+	maxLoopDuration      time.Duration
+	minHitInterval       time.Duration
 }
 
 // MockedHit represents a hit for mocked runner
@@ -25,11 +29,21 @@ type MockedHit struct {
 	HasEnqueue   bool
 	More         bool
 	MoreDeferred bool
+	Progress     *Progress
+
+	// ProtocolVersion is the negotiated version of the hit
+	ProtocolVersion string
 }
 
 // NewMocked returns a mocked Runner instance
 func NewMocked(hits []MockedHit, maxHitsPerLoop uint64) Runner {
+	return NewMockedWithClock(hits, maxHitsPerLoop, nil)
+}
+
+// NewMockedWithClock returns a mocked Runner instance, clock may be nil to use real time
+func NewMockedWithClock(hits []MockedHit, maxHitsPerLoop uint64, c clock.Clock) Runner {
 	m := &mockedRunner{}
+	m.clock = c
 	m.hits = hits
 
 	m.maxHitsPerLoop = maxHitsPerLoop
@@ -37,6 +51,14 @@ func NewMocked(hits []MockedHit, maxHitsPerLoop uint64) Runner {
 	return m
 }
 
+func (m *mockedRunner) GetClock() clock.Clock {
+	if m.clock == nil {
+		return clock.New()
+	}
+
+	return m.clock
+}
+
 func (m *mockedRunner) GetCooldownDuration() time.Duration {
 	return time.Millisecond
 }
@@ -57,6 +79,14 @@ func (m *mockedRunner) GetMaxHitsPerLoop() uint64 {
 	return m.maxHitsPerLoop
 }
 
+func (m *mockedRunner) GetMaxLoopDuration() time.Duration {
+	return m.maxLoopDuration
+}
+
+func (m *mockedRunner) GetMinHitInterval() time.Duration {
+	return m.minHitInterval
+}
+
 func (m *mockedRunner) Hit(url string) (Hit, error) {
 	var mockedHit *MockedHit
 	hit := Hit{}
@@ -72,7 +102,7 @@ func (m *mockedRunner) Hit(url string) (Hit, error) {
 	}
 
 	if mockedHit.Duration > 0 {
-		time.Sleep(mockedHit.Duration)
+		m.GetClock().Sleep(mockedHit.Duration)
 	}
 
 	if mockedHit.Error != nil {
@@ -81,7 +111,9 @@ func (m *mockedRunner) Hit(url string) (Hit, error) {
 
 	hit.Data.More = mockedHit.More
 	hit.Data.MoreDeferred = mockedHit.MoreDeferred
+	hit.Data.Progress = mockedHit.Progress
 	hit.Enqueue = mockedHit.Enqueue
 	hit.HasEnqueue = mockedHit.HasEnqueue
+	hit.ProtocolVersion = mockedHit.ProtocolVersion
 	return hit, nil
 }
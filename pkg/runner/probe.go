@@ -0,0 +1,153 @@
+package runner // import "github.com/daohoangson/go-deferred/pkg/runner"
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/daohoangson/go-deferred/internal"
+)
+
+var tlsVersions = map[uint16]string{
+	tls.VersionSSL30: "SSL 3.0",
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	0x0304:           "TLS 1.3",
+}
+
+// Probe hits the target once without looping and checks that it speaks the protocol,
+// client may be nil to use the default one. The error is only for a request that could not be sent.
+func Probe(client *http.Client, url string) (ProbeResult, error) {
+	result := ProbeResult{URL: url}
+	if client == nil {
+		client = internal.GetHTTPClient()
+	}
+
+	req, err := newHitRequest(url)
+	if err != nil {
+		return result, err
+	}
+
+	timeStart := time.Now()
+	resp, err := client.Do(req)
+	result.Latency = time.Since(timeStart)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	result.Elapsed = time.Since(timeStart)
+	if err != nil {
+		return result, err
+	}
+
+	result.StatusCode = resp.StatusCode
+	result.ContentType = resp.Header.Get("Content-Type")
+	result.ProtocolVersion = resp.Header.Get(internal.GetProtocolVersionHeaderKey())
+	if resp.TLS != nil {
+		result.TLS = newProbeTLS(resp.TLS, req.URL.Hostname())
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		result.Problems = append(result.Problems, fmt.Sprintf("status code is %d", resp.StatusCode))
+	}
+	if !strings.Contains(result.ContentType, "json") {
+		result.Problems = append(result.Problems, fmt.Sprintf("content type is %q", result.ContentType))
+	}
+
+	if enqueueValue := resp.Header.Get(internal.GetProtocolEnqueueHeaderKey()); len(enqueueValue) > 0 {
+		version := internal.NegotiateProtocolVersion(result.ProtocolVersion)
+		structured := internal.HasProtocolFeature(version, internal.ProtocolFeatureStructuredEnqueue)
+		if hint, err := ParseEnqueueHint(enqueueValue, structured); err == nil {
+			hit := Hit{}
+			hit.setEnqueueHint(hint, time.Now())
+			result.EnqueueHint = hint
+			if hit.HasEnqueue {
+				result.Enqueue = &hit.Enqueue
+			}
+		} else {
+			result.Problems = append(result.Problems, fmt.Sprintf("enqueue header is invalid (%s)", err))
+		}
+	}
+
+	result.Flavour, result.Problems = checkProbeBody(responseBody, &result.Data, result.Problems)
+	result.Valid = len(result.Problems) == 0
+
+	return result, nil
+}
+
+// checkProbeBody detects the flavour from the keys of the response, they must be booleans
+func checkProbeBody(body []byte, data *Data, problems []string) (Flavour, []string) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return FlavourUnknown, append(problems, fmt.Sprintf("response is not a JSON object (%s)", err))
+	}
+	if err := json.Unmarshal(body, data); err != nil {
+		return FlavourUnknown, append(problems, fmt.Sprintf("response does not match the protocol (%s)", err))
+	}
+
+	flavour := FlavourUnknown
+	for _, key := range []string{"more", "moreDeferred"} {
+		value, ok := fields[key]
+		if !ok {
+			continue
+		}
+
+		var more bool
+		if err := json.Unmarshal(value, &more); err != nil {
+			problems = append(problems, fmt.Sprintf("%s is not a boolean", key))
+		}
+
+		flavour = FlavourXF2
+		if key == "moreDeferred" {
+			flavour = FlavourXF1
+		}
+	}
+
+	if flavour == FlavourUnknown {
+		problems = append(problems, "response has neither moreDeferred nor more")
+	}
+
+	return flavour, problems
+}
+
+func newProbeTLS(state *tls.ConnectionState, host string) *ProbeTLS {
+	probeTLS := &ProbeTLS{
+		Version:     tlsVersions[state.Version],
+		CipherSuite: fmt.Sprintf("0x%04x", state.CipherSuite),
+		Protocol:    state.NegotiatedProtocol,
+	}
+	if len(probeTLS.Version) == 0 {
+		probeTLS.Version = fmt.Sprintf("0x%04x", state.Version)
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		probeTLS.VerifyError = "no certificate"
+		return probeTLS
+	}
+
+	cert := state.PeerCertificates[0]
+	probeTLS.Subject = cert.Subject.String()
+	probeTLS.Issuer = cert.Issuer.String()
+	probeTLS.NotAfter = cert.NotAfter
+
+	// the default client skips verification so it is done here for the report
+	intermediates := x509.NewCertPool()
+	for _, intermediate := range state.PeerCertificates[1:] {
+		intermediates.AddCert(intermediate)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates}); err != nil {
+		probeTLS.VerifyError = err.Error()
+	} else {
+		probeTLS.Verified = true
+	}
+
+	return probeTLS
+}
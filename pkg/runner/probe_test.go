@@ -0,0 +1,74 @@
+package runner // import "github.com/daohoangson/go-deferred/pkg/runner"
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daohoangson/go-deferred/internal"
+	"github.com/daohoangson/go-deferred/pkg/testserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbe(t *testing.T) {
+	s := testserver.New(2)
+	defer s.Close()
+
+	xf1, err := Probe(nil, s.GetDeferredURL())
+	assert.Nil(t, err)
+	assert.True(t, xf1.Valid)
+	assert.Equal(t, FlavourXF1, xf1.Flavour)
+	assert.True(t, xf1.Data.MoreDeferred)
+	assert.Equal(t, http.StatusOK, xf1.StatusCode)
+	assert.True(t, xf1.Latency > 0)
+	assert.Nil(t, xf1.Enqueue)
+	assert.Nil(t, xf1.TLS)
+
+	enqueue := int64(30)
+	s.SetConfig(testserver.Config{Enqueue: &enqueue})
+	xf2, err := Probe(nil, s.GetJobURL())
+	assert.Nil(t, err)
+	assert.True(t, xf2.Valid)
+	assert.Equal(t, FlavourXF2, xf2.Flavour)
+	assert.False(t, xf2.Data.More)
+	if assert.NotNil(t, xf2.Enqueue) {
+		assert.Equal(t, enqueue, *xf2.Enqueue)
+	}
+
+	s.SetConfig(testserver.Config{Malformed: true})
+	malformed, err := Probe(nil, s.GetDeferredURL())
+	assert.Nil(t, err)
+	assert.False(t, malformed.Valid)
+	assert.Equal(t, FlavourUnknown, malformed.Flavour)
+	assert.Equal(t, 2, len(malformed.Problems))
+
+	requests := s.GetRequests()
+	assert.Equal(t, internal.GetProtocolVersion(), requests[0].ProtocolVersion)
+
+	_, err = Probe(nil, "http://127.0.0.1:1/deferred.php")
+	assert.NotNil(t, err)
+}
+
+func TestProbeTLS(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(internal.GetProtocolVersionHeaderKey(), internal.GetProtocolVersion())
+		fmt.Fprint(w, `{"moreDeferred":"yes"}`)
+	}))
+	defer s.Close()
+
+	result, err := Probe(s.Client(), s.URL+"/deferred.php")
+	assert.Nil(t, err)
+	assert.False(t, result.Valid)
+	assert.Equal(t, internal.GetProtocolVersion(), result.ProtocolVersion)
+	if assert.NotNil(t, result.TLS) {
+		assert.NotEmpty(t, result.TLS.Version)
+		assert.NotEmpty(t, result.TLS.Subject)
+		assert.False(t, result.TLS.NotAfter.IsZero())
+
+		// the test certificate is not signed by a known authority
+		assert.False(t, result.TLS.Verified)
+		assert.NotEmpty(t, result.TLS.VerifyError)
+	}
+}
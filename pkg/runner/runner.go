@@ -7,65 +7,114 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/daohoangson/go-deferred/internal"
+	"github.com/daohoangson/go-deferred/pkg/cassette"
+	"github.com/daohoangson/go-deferred/pkg/clock"
 )
 
 type runner struct {
 	client *http.Client
+	clock  clock.Clock
 	logger *logrus.Logger
 
+	initError        error
+	protocolVersions sync.Map
+
 	cooldownDuration         time.Duration
 	dumpResponseOnParseError bool
 	errorsBeforeQuitting     uint64
 	maxHitsPerLoop           uint64
+	maxLoopDuration          time.Duration
+	minHitInterval           time.Duration
 }
 
 // New returns a new Runner instance
 func New(client *http.Client, logger *logrus.Logger) Runner {
+	return NewWithClock(client, logger, nil)
+}
+
+// NewWithClock returns a new Runner instance, clock may be nil to use real time
+func NewWithClock(client *http.Client, logger *logrus.Logger, c clock.Clock) Runner {
 	r := &runner{}
-	r.init(client, logger)
+	r.init(client, logger, c)
 	return r
 }
 
 // Loop keeps hitting the specified URL until there is no more jobs
 func Loop(r Runner, url string) (Hits, error) {
+	return LoopWithRequestID(r, url, "")
+}
+
+// LoopWithRequestID works like Loop and adds the request id to its log lines,
+// including the ones of each hit if the runner supports it
+func LoopWithRequestID(r Runner, url string, requestID string) (Hits, error) {
+	c := r.GetClock()
 	hits := Hits{}
-	hits.TimeStart = time.Now()
+	hits.TimeStart = c.Now()
 	errorsBeforeQuitting := r.GetErrorsBeforeQuitting()
 	maxHitsPerLoop := r.GetMaxHitsPerLoop()
+	maxLoopDuration := r.GetMaxLoopDuration()
+	minHitInterval := r.GetMinHitInterval()
 
 	var consecutiveErrorCount = uint64(0)
+	var lastHitStart time.Time
 	var someError error
 	outerLogger := r.GetLogger().WithFields(logrus.Fields{
-		"!": "Loop",
-		"_": url,
+		internal.LogFieldStep:   "loop",
+		internal.LogFieldTarget: url,
 	})
+	if len(requestID) > 0 {
+		outerLogger = outerLogger.WithField(internal.LogFieldRequestID, requestID)
+	}
 
 	for {
 		innerLogger := outerLogger.WithField("seq", len(hits.List))
 
+		var sleepDuration time.Duration
+		if consecutiveErrorCount > 0 {
+			sleepDuration = r.GetCooldownDuration()
+		} else if minHitInterval > 0 && !lastHitStart.IsZero() {
+			sleepDuration = minHitInterval - c.Now().Sub(lastHitStart)
+		}
+
+		if maxLoopDuration > 0 && len(hits.List) > 0 &&
+			c.Now().Sub(hits.TimeStart)+sleepDuration >= maxLoopDuration {
+			innerLogger.WithField("duration", maxLoopDuration).Warn("Reached max loop duration")
+			hits.StopReason = StopReasonMaxDuration
+			break
+		}
+
 		if consecutiveErrorCount > 0 {
-			sleepDuration := r.GetCooldownDuration()
 			innerLogger.WithFields(logrus.Fields{
 				"duration": sleepDuration,
 				"errors":   fmt.Sprintf("%d/%d", consecutiveErrorCount, errorsBeforeQuitting),
 			}).Warn("Cooling down...")
-			time.Sleep(sleepDuration)
+			c.Sleep(sleepDuration)
 		} else {
+			if sleepDuration > 0 {
+				innerLogger.WithField("duration", sleepDuration).Debug("Spacing...")
+				c.Sleep(sleepDuration)
+			}
 			innerLogger.Debug("Looping...")
 		}
 
-		hit, err := r.Hit(url)
+		lastHitStart = c.Now()
+		hit, err := hitWithRequestID(r, url, requestID)
 		hits.List = append(hits.List, hit)
+		if err == nil {
+			hits.ProtocolVersion = hit.ProtocolVersion
+		}
 		if err != nil {
 			innerLogger = innerLogger.WithError(err)
 			someError = err
 
 			consecutiveErrorCount++
 			if consecutiveErrorCount > errorsBeforeQuitting {
+				hits.StopReason = StopReasonErrors
 				break
 			}
 		} else {
@@ -79,19 +128,22 @@ func Loop(r Runner, url string) (Hits, error) {
 		}
 
 		if someError == nil && !data.MoreDeferred && !data.More {
+			hits.StopReason = StopReasonNoMore
 			break
 		}
 
 		if maxHitsPerLoop > 0 && uint64(len(hits.List)) == maxHitsPerLoop {
 			innerLogger.Warn("Reached max hits per loop")
+			hits.StopReason = StopReasonMaxHits
 			break
 		}
 	}
 
-	hits.TimeElapsed = time.Since(hits.TimeStart)
+	hits.TimeElapsed = c.Now().Sub(hits.TimeStart)
 	outerLogger = outerLogger.WithFields(logrus.Fields{
 		"elapsed": hits.TimeElapsed,
 		"len":     len(hits.List),
+		"reason":  hits.StopReason,
 	})
 
 	if someError != nil {
@@ -103,6 +155,10 @@ func Loop(r Runner, url string) (Hits, error) {
 	return hits, nil
 }
 
+func (r *runner) GetClock() clock.Clock {
+	return r.clock
+}
+
 func (r *runner) GetCooldownDuration() time.Duration {
 	return r.cooldownDuration
 }
@@ -115,6 +171,10 @@ func (r *runner) GetErrorsBeforeQuitting() uint64 {
 	return r.errorsBeforeQuitting
 }
 
+func (r *runner) GetInitError() error {
+	return r.initError
+}
+
 func (r *runner) GetLogger() *logrus.Logger {
 	return r.logger
 }
@@ -123,25 +183,38 @@ func (r *runner) GetMaxHitsPerLoop() uint64 {
 	return r.maxHitsPerLoop
 }
 
+func (r *runner) GetMaxLoopDuration() time.Duration {
+	return r.maxLoopDuration
+}
+
+func (r *runner) GetMinHitInterval() time.Duration {
+	return r.minHitInterval
+}
+
 func (r *runner) Hit(url string) (Hit, error) {
+	return r.HitWithRequestID(url, "")
+}
+
+func (r *runner) HitWithRequestID(url string, requestID string) (Hit, error) {
 	hit := Hit{}
-	hit.TimeStart = time.Now()
+	hit.TimeStart = r.clock.Now()
 	logger := r.logger.WithFields(logrus.Fields{
-		"!": "Once",
-		"_": url,
+		internal.LogFieldStep:   "once",
+		internal.LogFieldTarget: url,
 	})
+	if len(requestID) > 0 {
+		logger = logger.WithField(internal.LogFieldRequestID, requestID)
+	}
 
-	req, err := http.NewRequest("POST", url, nil)
+	req, err := newHitRequest(url)
 	if err != nil {
 		logger.WithError(err).Error("Could not prepare request")
 		return hit, err
 	}
-	req.Close = true
-	req.Header.Set(internal.GetProtocolVersionHeaderKey(), internal.GetProtocolVersion())
 
 	logger.Debug("Sending...")
 	resp, err := r.client.Do(req)
-	hit.TimeElapsed = time.Since(hit.TimeStart)
+	hit.TimeElapsed = r.clock.Now().Sub(hit.TimeStart)
 	logger.WithField("elapsed", hit.TimeElapsed).Debug("Received")
 
 	if err != nil {
@@ -155,6 +228,12 @@ func (r *runner) Hit(url string) (Hit, error) {
 		return hit, err
 	}
 
+	hit.ProtocolVersion = internal.NegotiateProtocolVersion(resp.Header.Get(internal.GetProtocolVersionHeaderKey()))
+	if previous, loaded := r.protocolVersions.Load(url); !loaded || previous != hit.ProtocolVersion {
+		r.protocolVersions.Store(url, hit.ProtocolVersion)
+		logger.WithField("version", hit.ProtocolVersion).Info("Negotiated protocol version")
+	}
+
 	err = json.Unmarshal(responseBody, &hit.Data)
 	if err != nil {
 		logger.WithError(err).WithField("status", resp.StatusCode).Error("Could not parse response")
@@ -166,12 +245,18 @@ func (r *runner) Hit(url string) (Hit, error) {
 		return hit, err
 	}
 
+	if hit.Data.Progress != nil && !internal.HasProtocolFeature(hit.ProtocolVersion, internal.ProtocolFeatureProgress) {
+		hit.Data.Progress = nil
+	}
+
 	enqueueValue := resp.Header.Get(internal.GetProtocolEnqueueHeaderKey())
 	if len(enqueueValue) > 0 {
-		if enqueue, err := strconv.ParseInt(enqueueValue, 10, 64); err == nil {
-			hit.HasEnqueue = true
-			hit.Enqueue = enqueue
-			logger = logger.WithField("enqueue", enqueue)
+		structured := internal.HasProtocolFeature(hit.ProtocolVersion, internal.ProtocolFeatureStructuredEnqueue)
+		if hint, err := ParseEnqueueHint(enqueueValue, structured); err == nil {
+			hit.setEnqueueHint(hint, r.clock.Now())
+			logger = logger.WithField("enqueue", enqueueValue)
+		} else {
+			logger.WithError(err).WithField("enqueue", enqueueValue).Warn("Could not parse enqueue header")
 		}
 	}
 
@@ -179,16 +264,98 @@ func (r *runner) Hit(url string) (Hit, error) {
 	return hit, nil
 }
 
-func (r *runner) init(client *http.Client, logger *logrus.Logger) {
+func (r *runner) SetCooldownDuration(cooldownDuration time.Duration) {
+	r.cooldownDuration = cooldownDuration
+}
+
+func (r *runner) SetErrorsBeforeQuitting(errorsBeforeQuitting uint64) {
+	r.errorsBeforeQuitting = errorsBeforeQuitting
+}
+
+func (r *runner) SetMaxHitsPerLoop(maxHitsPerLoop uint64) {
+	r.maxHitsPerLoop = maxHitsPerLoop
+}
+
+func (r *runner) SetMaxLoopDuration(maxLoopDuration time.Duration) {
+	r.maxLoopDuration = maxLoopDuration
+}
+
+func (r *runner) SetMinHitInterval(minHitInterval time.Duration) {
+	r.minHitInterval = minHitInterval
+}
+
+func hitWithRequestID(r Runner, url string, requestID string) (Hit, error) {
+	if rh, ok := r.(requestHitter); ok && len(requestID) > 0 {
+		return rh.HitWithRequestID(url, requestID)
+	}
+
+	return r.Hit(url)
+}
+
+// failedTransport fails every request with the error that prevented the runner from setting up
+type failedTransport struct {
+	err error
+}
+
+func (t failedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, t.err
+}
+
+func newHitRequest(url string) (*http.Request, error) {
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Close = true
+	req.Header.Set(internal.GetProtocolVersionHeaderKey(), internal.GetProtocolVersion())
+
+	return req, nil
+}
+
+func (r *runner) init(client *http.Client, logger *logrus.Logger, c clock.Clock) {
+	if logger == nil {
+		logger = internal.GetComponentLogger(internal.LogComponentRunner)
+	}
+	r.logger = logger
+
 	if client == nil {
 		client = internal.GetHTTPClient()
+
+		replayCassetteValue := os.Getenv("DEFERRED_REPLAY_CASSETTE")
+		recordCassetteValue := os.Getenv("DEFERRED_RECORD_CASSETTE")
+		if len(replayCassetteValue) > 0 {
+			replayRealTimeValue := os.Getenv("DEFERRED_REPLAY_REAL_TIME")
+			replayRealTime := replayRealTimeValue == "true" ||
+				replayRealTimeValue == "yes" ||
+				replayRealTimeValue == "1"
+			if replayer, err := cassette.NewReplayer(replayCassetteValue, replayRealTime); err == nil {
+				client = &http.Client{Transport: replayer, Timeout: client.Timeout}
+				logger.WithField("value", replayCassetteValue).Info("Replaying cassette")
+			} else {
+				logger.WithError(err).Error("Could not load cassette")
+				r.initError = err
+			}
+		} else if len(recordCassetteValue) > 0 {
+			if recorder, err := cassette.NewRecorder(recordCassetteValue, client.Transport); err == nil {
+				client = &http.Client{Transport: recorder, Timeout: client.Timeout}
+				logger.WithField("value", recordCassetteValue).Info("Recording cassette")
+			} else {
+				logger.WithError(err).Error("Could not open cassette")
+				r.initError = err
+			}
+		}
+
+		if r.initError != nil {
+			// falling back to the real client would send the hits to live targets
+			client = &http.Client{Transport: failedTransport{err: r.initError}}
+		}
 	}
 	r.client = client
 
-	if logger == nil {
-		logger = internal.GetLogger()
+	if c == nil {
+		c = clock.New()
 	}
-	r.logger = logger
+	r.clock = c
 
 	r.cooldownDuration = time.Minute
 	cooldownDurationValue := os.Getenv("DEFERRED_COOLDOWN_DURATION")
@@ -225,5 +392,21 @@ func (r *runner) init(client *http.Client, logger *logrus.Logger) {
 		}
 	}
 
+	maxLoopDurationValue := os.Getenv("DEFERRED_MAX_LOOP_DURATION")
+	if len(maxLoopDurationValue) > 0 {
+		if maxLoopDuration, err := time.ParseDuration(maxLoopDurationValue); err == nil {
+			r.maxLoopDuration = maxLoopDuration
+			logger.WithField("value", maxLoopDuration).Info("Updated max loop duration")
+		}
+	}
+
+	minHitIntervalValue := os.Getenv("DEFERRED_MIN_HIT_INTERVAL")
+	if len(minHitIntervalValue) > 0 {
+		if minHitInterval, err := time.ParseDuration(minHitIntervalValue); err == nil {
+			r.minHitInterval = minHitInterval
+			logger.WithField("value", minHitInterval).Info("Updated min hit interval")
+		}
+	}
+
 	logger.Debug("Initialized runner")
 }
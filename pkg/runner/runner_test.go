@@ -1,9 +1,19 @@
 package runner // import "github.com/daohoangson/go-deferred/pkg/runner"
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/Sirupsen/logrus"
+	"github.com/daohoangson/go-deferred/internal"
+	"github.com/daohoangson/go-deferred/pkg/clock"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -98,4 +108,124 @@ func TestMaxHitsPerLoop2(t *testing.T) {
 	loopHits, _ := Loop(m, url)
 
 	assert.Equal(t, 2, len(loopHits.List))
+	assert.Equal(t, StopReasonMaxHits, loopHits.StopReason)
+}
+
+func TestMaxLoopDuration(t *testing.T) {
+	m := &mockedRunner{}
+	m.hits = []MockedHit{
+		MockedHit{Duration: 50 * time.Millisecond, MoreDeferred: true},
+		MockedHit{Duration: 50 * time.Millisecond, MoreDeferred: true},
+		MockedHit{Duration: 50 * time.Millisecond, MoreDeferred: true},
+		MockedHit{},
+	}
+	m.maxLoopDuration = 75 * time.Millisecond
+	url := "max-loop-duration"
+
+	loopHits, err := Loop(m, url)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(loopHits.List))
+	assert.Equal(t, StopReasonMaxDuration, loopHits.StopReason)
+}
+
+func TestMinHitInterval(t *testing.T) {
+	m := &mockedRunner{}
+	m.hits = []MockedHit{
+		MockedHit{MoreDeferred: true},
+		MockedHit{MoreDeferred: true},
+		MockedHit{},
+	}
+	m.minHitInterval = 50 * time.Millisecond
+	url := "min-hit-interval"
+
+	loopHits, _ := Loop(m, url)
+
+	assert.Equal(t, 3, len(loopHits.List))
+	assert.Equal(t, StopReasonNoMore, loopHits.StopReason)
+	assert.True(t, loopHits.TimeElapsed >= 2*m.minHitInterval)
+}
+
+func TestMinHitIntervalWithinMaxLoopDuration(t *testing.T) {
+	m := &mockedRunner{}
+	m.hits = []MockedHit{
+		MockedHit{MoreDeferred: true},
+		MockedHit{MoreDeferred: true},
+		MockedHit{},
+	}
+	m.maxLoopDuration = 75 * time.Millisecond
+	m.minHitInterval = 50 * time.Millisecond
+	url := "min-hit-interval-within-max-loop-duration"
+
+	loopHits, _ := Loop(m, url)
+
+	assert.Equal(t, 2, len(loopHits.List))
+	assert.Equal(t, StopReasonMaxDuration, loopHits.StopReason)
+}
+
+func TestLoopWithRequestID(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":"Done"}`))
+	}))
+	defer s.Close()
+
+	var b bytes.Buffer
+	logger := logrus.New()
+	logger.Formatter = &logrus.JSONFormatter{}
+	logger.Level = logrus.DebugLevel
+	logger.Out = &b
+
+	r := New(s.Client(), logger)
+	_, err := LoopWithRequestID(r, s.URL, "req-1")
+	assert.Nil(t, err)
+
+	steps := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		var fields map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &fields))
+		if fields[internal.LogFieldTarget] != s.URL {
+			continue
+		}
+
+		assert.Equal(t, "req-1", fields[internal.LogFieldRequestID], line)
+		steps[fields[internal.LogFieldStep].(string)] = true
+	}
+	assert.True(t, steps["loop"])
+	assert.True(t, steps["once"])
+}
+
+func TestCassetteError(t *testing.T) {
+	requests := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{}`))
+	}))
+	defer s.Close()
+
+	defer os.Unsetenv("DEFERRED_REPLAY_CASSETTE")
+	os.Setenv("DEFERRED_REPLAY_CASSETTE", "testdata/missing.jsonl")
+
+	r := New(nil, nil)
+	assert.NotNil(t, r.(Failable).GetInitError())
+
+	// the hits fail instead of reaching the live target
+	_, err := r.Hit(s.URL)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, requests)
+}
+
+func TestNewWithClock(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer s.Close()
+
+	c := clock.NewTestFake()
+	r := NewWithClock(s.Client(), nil, c)
+	assert.Equal(t, c, r.GetClock())
+
+	hit, err := r.Hit(s.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, c.Now(), hit.TimeStart)
+	assert.Equal(t, time.Duration(0), hit.TimeElapsed)
 }
@@ -0,0 +1,314 @@
+package runner // import "github.com/daohoangson/go-deferred/pkg/runner"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/daohoangson/go-deferred/internal"
+	"github.com/daohoangson/go-deferred/pkg/clock"
+	"gopkg.in/yaml.v3"
+)
+
+// ScriptedRunner represents a mocked Runner that follows per-URL scripts
+type ScriptedRunner interface {
+	Runner
+	Calls() []ScriptedCall
+}
+
+// Scenario represents the scripts for all targets of a scripted runner
+type Scenario struct {
+	CooldownDuration     ScriptedDuration `json:"cooldown_duration"`
+	ErrorsBeforeQuitting uint64           `json:"errors_before_quitting"`
+	MaxHitsPerLoop       uint64           `json:"max_hits_per_loop"`
+	MaxLoopDuration      ScriptedDuration `json:"max_loop_duration"`
+	MinHitInterval       ScriptedDuration `json:"min_hit_interval"`
+	Seed                 int64            `json:"seed"`
+
+	// Targets are keyed by URL, use "*" for a script that matches any other URL
+	Targets map[string]*Script `json:"targets"`
+}
+
+// Script represents how a target responds to consecutive hits
+type Script struct {
+	Hits []ScriptedHit `json:"hits"`
+
+	// Repeat starts over from the first hit after the last one
+	Repeat bool `json:"repeat"`
+}
+
+// ScriptedHit represents one step of a script
+type ScriptedHit struct {
+	Enqueue      *int64          `json:"enqueue"`
+	Error        string          `json:"error"`
+	Latency      ScriptedLatency `json:"latency"`
+	Message      string          `json:"message"`
+	More         bool            `json:"more"`
+	MoreDeferred bool            `json:"more_deferred"`
+	Progress     *Progress       `json:"progress"`
+
+	// EnqueueHeader is parsed like a real header, structured hints need a protocol version
+	EnqueueHeader string `json:"enqueue_header"`
+
+	// ProtocolVersion is advertised by the target, it is negotiated like a real response
+	ProtocolVersion string `json:"protocol_version"`
+
+	// Times repeats this step, zero is the same as one
+	Times int `json:"times"`
+}
+
+// ScriptedLatency represents a uniform distribution of hit durations
+type ScriptedLatency struct {
+	Min ScriptedDuration `json:"min"`
+	Max ScriptedDuration `json:"max"`
+}
+
+// ScriptedDuration represents a duration that can be unmarshalled from "250ms" or nanoseconds
+type ScriptedDuration time.Duration
+
+// ScriptedCall represents a recorded hit of a scripted runner
+type ScriptedCall struct {
+	URL   string
+	Seq   int
+	Hit   Hit
+	Error error
+}
+
+// ScriptedError represents an error produced by a script
+type ScriptedError struct {
+	Kind string
+	URL  string
+}
+
+// Error kinds supported by scripts
+const (
+	ScriptedErrorNetwork = "network"
+	ScriptedErrorParse   = "parse"
+	ScriptedErrorStatus  = "status"
+	ScriptedErrorTimeout = "timeout"
+)
+
+type scriptedRunner struct {
+	clock    clock.Clock
+	scenario *Scenario
+
+	mutex     sync.Mutex
+	calls     []ScriptedCall
+	positions map[string]int
+	random    *rand.Rand
+	steps     map[*Script][]ScriptedHit
+}
+
+// LoadScenario reads a scenario file, it is YAML if the extension is .yaml or .yml, JSON otherwise
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		// YAML is converted so that the JSON keys and durations apply to both formats
+		var value interface{}
+		if err := yaml.Unmarshal(data, &value); err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(value); err != nil {
+			return nil, err
+		}
+	}
+
+	scenario := &Scenario{}
+	if err := json.Unmarshal(data, scenario); err != nil {
+		return nil, err
+	}
+
+	return scenario, nil
+}
+
+// NewScripted returns a ScriptedRunner instance, clock may be nil to use real time
+func NewScripted(scenario *Scenario, c clock.Clock) ScriptedRunner {
+	if c == nil {
+		c = clock.New()
+	}
+
+	s := &scriptedRunner{}
+	s.clock = c
+	s.scenario = scenario
+	s.positions = make(map[string]int)
+	s.random = rand.New(rand.NewSource(scenario.Seed))
+
+	s.steps = make(map[*Script][]ScriptedHit)
+	for _, script := range scenario.Targets {
+		var steps []ScriptedHit
+		for _, hit := range script.Hits {
+			for i := 0; i < hit.Times || i == 0; i++ {
+				steps = append(steps, hit)
+			}
+		}
+		s.steps[script] = steps
+	}
+
+	return s
+}
+
+func (d *ScriptedDuration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case float64:
+		*d = ScriptedDuration(v)
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = ScriptedDuration(parsed)
+	default:
+		return errors.New("Invalid duration")
+	}
+
+	return nil
+}
+
+func (e *ScriptedError) Error() string {
+	return fmt.Sprintf("Mocked %s error for %s", e.Kind, e.URL)
+}
+
+func (s *scriptedRunner) Calls() []ScriptedCall {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	calls := make([]ScriptedCall, len(s.calls))
+	copy(calls, s.calls)
+	return calls
+}
+
+func (s *scriptedRunner) GetClock() clock.Clock {
+	return s.clock
+}
+
+func (s *scriptedRunner) GetCooldownDuration() time.Duration {
+	return time.Duration(s.scenario.CooldownDuration)
+}
+
+func (s *scriptedRunner) GetDumpResponseOnParseError() bool {
+	return false
+}
+
+func (s *scriptedRunner) GetErrorsBeforeQuitting() uint64 {
+	return s.scenario.ErrorsBeforeQuitting
+}
+
+func (s *scriptedRunner) GetLogger() *logrus.Logger {
+	return internal.GetLogger()
+}
+
+func (s *scriptedRunner) GetMaxHitsPerLoop() uint64 {
+	return s.scenario.MaxHitsPerLoop
+}
+
+func (s *scriptedRunner) GetMaxLoopDuration() time.Duration {
+	return time.Duration(s.scenario.MaxLoopDuration)
+}
+
+func (s *scriptedRunner) GetMinHitInterval() time.Duration {
+	return time.Duration(s.scenario.MinHitInterval)
+}
+
+func (s *scriptedRunner) Hit(url string) (Hit, error) {
+	hit := Hit{}
+	hit.TimeStart = s.clock.Now()
+
+	s.mutex.Lock()
+	seq := s.positions[url]
+	s.positions[url] = seq + 1
+	step, ok := s.nextStep(url, seq)
+	var latency time.Duration
+	if ok {
+		latency = s.pickLatency(step.Latency)
+	}
+	s.mutex.Unlock()
+
+	var err error
+	if !ok {
+		err = errors.New("No hit")
+	} else {
+		if latency > 0 {
+			s.clock.Sleep(latency)
+		}
+
+		if len(step.Error) > 0 {
+			err = &ScriptedError{Kind: step.Error, URL: url}
+		} else {
+			hit.Data.Message = step.Message
+			hit.Data.More = step.More
+			hit.Data.MoreDeferred = step.MoreDeferred
+			hit.ProtocolVersion = internal.NegotiateProtocolVersion(step.ProtocolVersion)
+			if internal.HasProtocolFeature(hit.ProtocolVersion, internal.ProtocolFeatureProgress) {
+				hit.Data.Progress = step.Progress
+			}
+			if step.Enqueue != nil {
+				hit.Enqueue = *step.Enqueue
+				hit.HasEnqueue = true
+			}
+			if len(step.EnqueueHeader) > 0 {
+				structured := internal.HasProtocolFeature(hit.ProtocolVersion, internal.ProtocolFeatureStructuredEnqueue)
+				if hint, hintErr := ParseEnqueueHint(step.EnqueueHeader, structured); hintErr == nil {
+					hit.setEnqueueHint(hint, s.clock.Now())
+				}
+			}
+		}
+	}
+	hit.TimeElapsed = s.clock.Now().Sub(hit.TimeStart)
+
+	s.mutex.Lock()
+	s.calls = append(s.calls, ScriptedCall{URL: url, Seq: seq, Hit: hit, Error: err})
+	s.mutex.Unlock()
+
+	return hit, err
+}
+
+func (s *scriptedRunner) nextStep(url string, seq int) (ScriptedHit, bool) {
+	script, ok := s.scenario.Targets[url]
+	if !ok {
+		script, ok = s.scenario.Targets["*"]
+	}
+	if !ok {
+		return ScriptedHit{}, false
+	}
+
+	steps := s.steps[script]
+	if len(steps) == 0 {
+		return ScriptedHit{}, false
+	}
+
+	if seq >= len(steps) {
+		if !script.Repeat {
+			return ScriptedHit{}, false
+		}
+		seq = seq % len(steps)
+	}
+
+	return steps[seq], true
+}
+
+func (s *scriptedRunner) pickLatency(latency ScriptedLatency) time.Duration {
+	min := time.Duration(latency.Min)
+	max := time.Duration(latency.Max)
+	if max <= min {
+		return min
+	}
+
+	return min + time.Duration(s.random.Int63n(int64(max-min)))
+}
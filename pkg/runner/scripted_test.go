@@ -0,0 +1,94 @@
+package runner // import "github.com/daohoangson/go-deferred/pkg/runner"
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daohoangson/go-deferred/pkg/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScriptedBusy(t *testing.T) {
+	s := testScripted(t)
+	url := "busy"
+
+	loopHits, err := Loop(s, url)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(loopHits.List))
+	for _, hit := range loopHits.List[:2] {
+		assert.True(t, hit.TimeElapsed >= 10*time.Millisecond)
+		assert.True(t, hit.TimeElapsed < 20*time.Millisecond)
+	}
+
+	lastHit := loopHits.List[2]
+	assert.Equal(t, "Done", lastHit.Data.Message)
+	assert.True(t, lastHit.HasEnqueue)
+	assert.Equal(t, int64(30), lastHit.Enqueue)
+}
+
+func TestScriptedFlakyRepeat(t *testing.T) {
+	s := testScripted(t)
+	url := "flaky"
+
+	for i := 0; i < 2; i++ {
+		_, err := Loop(s, url)
+		assert.Nil(t, err)
+	}
+
+	calls := s.Calls()
+	assert.Equal(t, 4, len(calls))
+	for i, call := range calls {
+		assert.Equal(t, url, call.URL)
+		assert.Equal(t, i, call.Seq)
+
+		if i%2 == 0 {
+			scriptedError, ok := call.Error.(*ScriptedError)
+			assert.True(t, ok)
+			assert.Equal(t, ScriptedErrorTimeout, scriptedError.Kind)
+			assert.Equal(t, time.Second, call.Hit.TimeElapsed)
+		} else {
+			assert.Nil(t, call.Error)
+			assert.Equal(t, "Recovered", call.Hit.Data.Message)
+		}
+	}
+}
+
+func TestScriptedFallback(t *testing.T) {
+	s := testScripted(t)
+
+	_, err1 := s.Hit("other")
+	assert.Nil(t, err1)
+
+	_, err2 := s.Hit("other")
+	assert.NotNil(t, err2)
+
+	calls := s.Calls()
+	assert.Equal(t, 2, len(calls))
+	assert.Equal(t, 1, calls[1].Seq)
+}
+
+func TestLoadScenarioYAML(t *testing.T) {
+	fromJSON, err := LoadScenario("testdata/scenario.json")
+	assert.Nil(t, err)
+
+	fromYAML, err := LoadScenario("testdata/scenario.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, fromJSON, fromYAML)
+
+	_, err = LoadScenario("testdata/missing.yml")
+	assert.NotNil(t, err)
+}
+
+func testScripted(t *testing.T) ScriptedRunner {
+	scenario, err := LoadScenario("testdata/scenario.json")
+	assert.Nil(t, err)
+
+	return NewScripted(scenario, newTestClock())
+}
+
+func newTestClock() clock.Clock {
+	c := clock.NewTestFake()
+	c.SetAutoAdvance(true)
+	return c
+}
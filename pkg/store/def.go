@@ -0,0 +1,83 @@
+package store // import "github.com/daohoangson/go-deferred/pkg/store"
+import "time"
+
+// Store represents the storage of queued targets and their stats
+type Store interface {
+	// Enqueue stores the item unless its target is already queued
+	// for a time between now and item.Time, returns true if stored
+	Enqueue(item Item, now time.Time) (bool, error)
+
+	// GetDue returns the items queued at or before t
+	GetDue(t time.Time) ([]Item, error)
+
+	// GetNext returns the earliest queued time after cutOff, if any
+	GetNext(cutOff time.Time) (time.Time, bool, error)
+
+	GetQueued() ([]Item, error)
+	GetStats(url string) (Stats, error)
+	GetStatsAll() (map[string]Stats, error)
+	Remove(url string) error
+
+	// UpdateStats atomically applies update to the stats of url and returns the result
+	UpdateStats(url string, update func(*Stats)) (Stats, error)
+}
+
+// Locker represents a Store that can coordinate several daemons sharing it
+type Locker interface {
+	// Lock acquires the lease of key for holder until now+ttl,
+	// returns false if another holder has an unexpired lease
+	Lock(key string, holder string, now time.Time, ttl time.Duration) (bool, error)
+
+	// Unlock releases the lease of key if it is held by holder
+	Unlock(key string, holder string) error
+}
+
+// Item represents a queued target
+type Item struct {
+	URL       string    `json:"url"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Priority  int       `json:"priority,omitempty"`
+}
+
+// Stats represents metrics for an URL
+type Stats struct {
+	CounterEnqueues   uint64    `json:"counter_enqueues"`
+	CounterErrors     uint64    `json:"counter_errors"`
+	CounterLoops      uint64    `json:"counter_loops"`
+	CounterWakeUps    uint64    `json:"counter_on_timers"`
+	ConsecutiveErrors uint64    `json:"consecutive_errors"`
+	LastHit           time.Time `json:"last_hit"`
+
+	// Cadence is the moving average of intervals between /queue requests from the target
+	Cadence    time.Duration `json:"cadence"`
+	LastQueued time.Time     `json:"last_queued"`
+
+	// Polling is set while a stale target is being hit on schedule, until it sends /queue again
+	Polling bool `json:"polling"`
+
+	// Stopped is set when the target has no more work, it is not polled until it sends /queue again
+	Stopped bool `json:"stopped,omitempty"`
+
+	// ProtocolVersion is negotiated with the target in its last successful loop
+	ProtocolVersion string `json:"protocol_version,omitempty"`
+
+	// Progress is aggregated from targets that report their jobs, it is replaced rather than modified
+	Progress *ProgressStats `json:"progress,omitempty"`
+}
+
+// ProgressStats represents the jobs reported by a target
+type ProgressStats struct {
+	CounterJobs    uint64              `json:"counter_jobs"`
+	Current        string              `json:"current,omitempty"`
+	CurrentPercent float64             `json:"current_percent,omitempty"`
+	Jobs           map[string]JobStats `json:"jobs,omitempty"`
+	Remaining      *uint64             `json:"remaining,omitempty"`
+	UpdatedAt      time.Time           `json:"updated_at"`
+}
+
+// JobStats represents the runs of a job name
+type JobStats struct {
+	Count    uint64        `json:"count"`
+	Duration time.Duration `json:"duration"`
+}
@@ -0,0 +1,208 @@
+package store // import "github.com/daohoangson/go-deferred/pkg/store"
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+type file struct {
+	*memory
+
+	file    *os.File
+	path    string
+	records int
+}
+
+type fileRecord struct {
+	Op    string `json:"op"`
+	Item  *Item  `json:"item,omitempty"`
+	Stats *Stats `json:"stats,omitempty"`
+	URL   string `json:"url,omitempty"`
+}
+
+const (
+	fileOpEnqueue = "enqueue"
+	fileOpRemove  = "remove"
+	fileOpStats   = "stats"
+
+	// the journal is compacted when it has this many records more than the live data
+	fileCompactThreshold = 1000
+)
+
+// NewFile returns a Store that keeps everything in memory
+// and persists changes to a journal file on disk
+func NewFile(path string) (Store, error) {
+	f := &file{}
+	f.memory = newMemory()
+	f.path = path
+
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+
+	if err := f.compact(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *file) Enqueue(item Item, now time.Time) (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !f.canEnqueue(item, now) {
+		return false, nil
+	}
+
+	if err := f.write(fileRecord{Op: fileOpEnqueue, Item: &item}); err != nil {
+		return false, err
+	}
+
+	f.queued[item.URL] = item
+	return true, nil
+}
+
+func (f *file) Remove(url string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.write(fileRecord{Op: fileOpRemove, URL: url}); err != nil {
+		return err
+	}
+
+	delete(f.queued, url)
+	return nil
+}
+
+func (f *file) UpdateStats(url string, update func(*Stats)) (Stats, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	prev := f.stats[url]
+	stats := prev
+	update(&stats)
+	if err := f.write(fileRecord{Op: fileOpStats, URL: url, Stats: &stats}); err != nil {
+		return prev, err
+	}
+
+	f.stats[url] = stats
+	return stats, nil
+}
+
+func (f *file) apply(record fileRecord) {
+	switch record.Op {
+	case fileOpEnqueue:
+		if record.Item != nil {
+			f.queued[record.Item.URL] = *record.Item
+		}
+	case fileOpRemove:
+		delete(f.queued, record.URL)
+	case fileOpStats:
+		if record.Stats != nil {
+			f.stats[record.URL] = *record.Stats
+		}
+	}
+}
+
+func (f *file) compact() error {
+	tmpPath := f.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	e := json.NewEncoder(w)
+	records := 0
+	for _, item := range f.queued {
+		item := item
+		if err = e.Encode(fileRecord{Op: fileOpEnqueue, Item: &item}); err != nil {
+			break
+		}
+		records++
+	}
+	for url, stats := range f.stats {
+		stats := stats
+		if err == nil {
+			err = e.Encode(fileRecord{Op: fileOpStats, URL: url, Stats: &stats})
+			records++
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if f.file != nil {
+		f.file.Close()
+	}
+	if err := os.Rename(tmpPath, f.path); err != nil {
+		os.Remove(tmpPath)
+
+		// keep appending to the original journal
+		f.file, _ = os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		return err
+	}
+
+	f.file, err = os.OpenFile(f.path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.records = records
+	return err
+}
+
+func (f *file) load() error {
+	existing, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer existing.Close()
+
+	scanner := bufio.NewScanner(existing)
+	for scanner.Scan() {
+		var record fileRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// the last line may be incomplete after a crash
+			continue
+		}
+		f.apply(record)
+	}
+
+	return scanner.Err()
+}
+
+// write appends the record to the journal, it is called before memory is changed
+// so that a failed write leaves both unchanged
+func (f *file) write(record fileRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if f.records >= len(f.queued)+len(f.stats)+fileCompactThreshold {
+		// a failed compaction keeps the original journal, it is tried again with the next record
+		f.compact()
+	}
+
+	if f.file == nil {
+		return errors.New("store: journal is not open")
+	}
+	if _, err := f.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	f.records++
+	return nil
+}
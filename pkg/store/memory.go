@@ -0,0 +1,167 @@
+package store // import "github.com/daohoangson/go-deferred/pkg/store"
+
+import (
+	"sync"
+	"time"
+)
+
+type memory struct {
+	mutex  sync.Mutex
+	leases map[string]lease
+	queued map[string]Item
+	stats  map[string]Stats
+}
+
+type lease struct {
+	holder    string
+	expiresAt time.Time
+}
+
+// NewMemory returns a Store that keeps everything in memory
+func NewMemory() Store {
+	return newMemory()
+}
+
+func newMemory() *memory {
+	m := &memory{}
+	m.leases = make(map[string]lease)
+	m.queued = make(map[string]Item)
+	m.stats = make(map[string]Stats)
+	return m
+}
+
+func (m *memory) Enqueue(item Item, now time.Time) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.enqueue(item, now), nil
+}
+
+func (m *memory) GetDue(t time.Time) ([]Item, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var items []Item
+	for _, item := range m.queued {
+		if !item.Time.After(t) {
+			items = append(items, item)
+		}
+	}
+
+	return items, nil
+}
+
+func (m *memory) GetNext(cutOff time.Time) (time.Time, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var next time.Time
+	found := false
+	for _, item := range m.queued {
+		if cutOff.Before(item.Time) && (!found || item.Time.Before(next)) {
+			next = item.Time
+			found = true
+		}
+	}
+
+	return next, found, nil
+}
+
+func (m *memory) GetQueued() ([]Item, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	items := make([]Item, 0, len(m.queued))
+	for _, item := range m.queued {
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func (m *memory) GetStats(url string) (Stats, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.stats[url], nil
+}
+
+func (m *memory) GetStatsAll() (map[string]Stats, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	all := make(map[string]Stats, len(m.stats))
+	for url, stats := range m.stats {
+		all[url] = stats
+	}
+
+	return all, nil
+}
+
+func (m *memory) Lock(key string, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if existing, ok := m.leases[key]; ok {
+		if existing.holder != holder && now.Before(existing.expiresAt) {
+			return false, nil
+		}
+	}
+
+	m.leases[key] = lease{holder: holder, expiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *memory) Remove(url string) error {
+	m.mutex.Lock()
+	delete(m.queued, url)
+	m.mutex.Unlock()
+
+	return nil
+}
+
+func (m *memory) Unlock(key string, holder string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if existing, ok := m.leases[key]; ok && existing.holder == holder {
+		delete(m.leases, key)
+	}
+
+	return nil
+}
+
+func (m *memory) UpdateStats(url string, update func(*Stats)) (Stats, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.updateStats(url, update), nil
+}
+
+// canEnqueue returns false if the item would replace an earlier pending one
+func (m *memory) canEnqueue(item Item, now time.Time) bool {
+	if existing, ok := m.queued[item.URL]; ok {
+		if now.Before(existing.Time) && existing.Time.Before(item.Time) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *memory) enqueue(item Item, now time.Time) bool {
+	if !m.canEnqueue(item, now) {
+		return false
+	}
+
+	m.queued[item.URL] = item
+	return true
+}
+
+func (m *memory) updateStats(url string, update func(*Stats)) Stats {
+	stats := m.stats[url]
+	update(&stats)
+	m.stats[url] = stats
+
+	return stats
+}
@@ -0,0 +1,529 @@
+package store // import "github.com/daohoangson/go-deferred/pkg/store"
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type redisStore struct {
+	address  string
+	db       string
+	password string
+	pool     chan *redisConn
+	prefix   string
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type redisError string
+
+// redisMaxRetries limits optimistic transactions that keep being interrupted by other clients
+const redisMaxRetries = 100
+
+// redisTimeout limits dialing and each command so that a stalled server does not block a hit forever
+var redisTimeout = 5 * time.Second
+
+var errRedisNil = errors.New("redis: nil")
+var errRedisRetries = errors.New("redis: too many retries")
+
+// NewRedis returns a Store backed by Redis, due times are kept in a sorted set and stats in a hash.
+// Each write also increments a counter per target, transactions watch that counter
+// so that they only conflict with writes for the same target.
+// The address can be host:port or redis://:password@host:port/db, keys are prefixed with prefix.
+func NewRedis(address string, prefix string) (Store, error) {
+	s := &redisStore{}
+	s.address = address
+	s.pool = make(chan *redisConn, 8)
+	s.prefix = prefix
+
+	if strings.HasPrefix(address, "redis://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+
+		s.address = u.Host
+		if u.User != nil {
+			s.password, _ = u.User.Password()
+		}
+		s.db = strings.TrimPrefix(u.Path, "/")
+	}
+
+	if _, err := s.do("PING"); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+func (s *redisStore) Enqueue(item Item, now time.Time) (bool, error) {
+	itemJSON, err := json.Marshal(item)
+	if err != nil {
+		return false, err
+	}
+
+	stored := false
+	versionKey := s.versionKey("items", item.URL)
+	err = s.watch([]string{versionKey}, func(c *redisConn) ([][]string, error) {
+		stored = false
+
+		existing, err := s.getItem(c, item.URL)
+		if err == nil && now.Before(existing.Time) && existing.Time.Before(item.Time) {
+			return nil, nil
+		}
+		if err != nil && err != errRedisNil {
+			return nil, err
+		}
+
+		stored = true
+		return [][]string{
+			{"ZADD", s.key("queue"), redisScore(item.Time), item.URL},
+			{"HSET", s.key("items"), item.URL, string(itemJSON)},
+			{"INCR", versionKey},
+		}, nil
+	})
+
+	return stored, err
+}
+
+func (s *redisStore) GetDue(t time.Time) ([]Item, error) {
+	items, err := s.getItems("ZRANGEBYSCORE", s.key("queue"), "-inf", redisScore(t))
+	if err != nil {
+		return nil, err
+	}
+
+	// scores have millisecond precision
+	var due []Item
+	for _, item := range items {
+		if !item.Time.After(t) {
+			due = append(due, item)
+		}
+	}
+
+	return due, nil
+}
+
+func (s *redisStore) GetNext(cutOff time.Time) (time.Time, bool, error) {
+	var next time.Time
+	found := false
+
+	// scores have millisecond precision so a few items may be at or before cutOff
+	items, err := s.getItems("ZRANGEBYSCORE", s.key("queue"), redisScore(cutOff), "+inf", "LIMIT", "0", "16")
+	for _, item := range items {
+		if cutOff.Before(item.Time) && (!found || item.Time.Before(next)) {
+			next = item.Time
+			found = true
+		}
+	}
+
+	return next, found, err
+}
+
+func (s *redisStore) GetQueued() ([]Item, error) {
+	return s.getItems("ZRANGE", s.key("queue"), "0", "-1")
+}
+
+func (s *redisStore) GetStats(url string) (Stats, error) {
+	stats := Stats{}
+
+	reply, err := s.do("HGET", s.key("stats"), url)
+	if err == errRedisNil {
+		return stats, nil
+	}
+	if err != nil {
+		return stats, err
+	}
+
+	err = json.Unmarshal([]byte(reply.(string)), &stats)
+	return stats, err
+}
+
+func (s *redisStore) GetStatsAll() (map[string]Stats, error) {
+	reply, err := s.do("HGETALL", s.key("stats"))
+	if err != nil {
+		return nil, err
+	}
+
+	values, _ := reply.([]interface{})
+	all := make(map[string]Stats)
+	for i := 0; i+1 < len(values); i += 2 {
+		url, _ := values[i].(string)
+		data, _ := values[i+1].(string)
+
+		stats := Stats{}
+		if err := json.Unmarshal([]byte(data), &stats); err != nil {
+			return nil, err
+		}
+		all[url] = stats
+	}
+
+	return all, nil
+}
+
+func (s *redisStore) Lock(key string, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	leaseKey := s.key("lease:" + key)
+	locked := false
+
+	err := s.watch([]string{leaseKey}, func(c *redisConn) ([][]string, error) {
+		locked = false
+
+		reply, err := c.do("GET", leaseKey)
+		if err == nil {
+			leaseHolder, expires := parseRedisLease(reply.(string))
+			if leaseHolder != holder && now.Before(expires) {
+				return nil, nil
+			}
+		} else if err != errRedisNil {
+			return nil, err
+		}
+
+		// the Redis expiry only cleans up abandoned leases, now decides who holds it
+		locked = true
+		value := holder + " " + strconv.FormatInt(now.Add(ttl).UnixNano(), 10)
+		px := strconv.FormatInt(int64(ttl/time.Millisecond)+1, 10)
+		return [][]string{{"SET", leaseKey, value, "PX", px}}, nil
+	})
+
+	return locked, err
+}
+
+func (s *redisStore) Remove(url string) error {
+	return s.watch(nil, func(c *redisConn) ([][]string, error) {
+		return [][]string{
+			{"ZREM", s.key("queue"), url},
+			{"HDEL", s.key("items"), url},
+			{"INCR", s.versionKey("items", url)},
+		}, nil
+	})
+}
+
+func (s *redisStore) Unlock(key string, holder string) error {
+	leaseKey := s.key("lease:" + key)
+
+	return s.watch([]string{leaseKey}, func(c *redisConn) ([][]string, error) {
+		reply, err := c.do("GET", leaseKey)
+		if err == errRedisNil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if leaseHolder, _ := parseRedisLease(reply.(string)); leaseHolder != holder {
+			return nil, nil
+		}
+
+		return [][]string{{"DEL", leaseKey}}, nil
+	})
+}
+
+func (s *redisStore) UpdateStats(url string, update func(*Stats)) (Stats, error) {
+	var stats Stats
+
+	versionKey := s.versionKey("stats", url)
+	err := s.watch([]string{versionKey}, func(c *redisConn) ([][]string, error) {
+		stats = Stats{}
+
+		reply, err := c.do("HGET", s.key("stats"), url)
+		if err == nil {
+			if err := json.Unmarshal([]byte(reply.(string)), &stats); err != nil {
+				return nil, err
+			}
+		} else if err != errRedisNil {
+			return nil, err
+		}
+
+		update(&stats)
+		data, err := json.Marshal(stats)
+		if err != nil {
+			return nil, err
+		}
+
+		return [][]string{
+			{"HSET", s.key("stats"), url, string(data)},
+			{"INCR", versionKey},
+		}, nil
+	})
+
+	return stats, err
+}
+
+func (s *redisStore) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", s.address, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if len(s.password) > 0 {
+		if _, err := c.do("AUTH", s.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if len(s.db) > 0 {
+		if _, err := c.do("SELECT", s.db); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (s *redisStore) do(args ...string) (interface{}, error) {
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.do(args...)
+	s.put(c, err)
+	return reply, err
+}
+
+func (s *redisStore) get() (*redisConn, error) {
+	select {
+	case c := <-s.pool:
+		return c, nil
+	default:
+		return s.dial()
+	}
+}
+
+func (s *redisStore) getItem(c *redisConn, url string) (Item, error) {
+	item := Item{}
+
+	reply, err := c.do("HGET", s.key("items"), url)
+	if err != nil {
+		return item, err
+	}
+
+	err = json.Unmarshal([]byte(reply.(string)), &item)
+	return item, err
+}
+
+func (s *redisStore) getItems(args ...string) ([]Item, error) {
+	reply, err := s.do(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	urls, _ := reply.([]interface{})
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	hmgetArgs := []string{"HMGET", s.key("items")}
+	for _, url := range urls {
+		hmgetArgs = append(hmgetArgs, url.(string))
+	}
+	reply, err = s.do(hmgetArgs...)
+	if err != nil {
+		return nil, err
+	}
+
+	values, _ := reply.([]interface{})
+	var items []Item
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			// removed in between
+			continue
+		}
+
+		item := Item{}
+		if err := json.Unmarshal([]byte(data), &item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Time.Before(items[j].Time) })
+	return items, nil
+}
+
+func (s *redisStore) key(name string) string {
+	return s.prefix + name
+}
+
+// versionKey returns the key of the counter that is incremented by each write to the hash field of url
+func (s *redisStore) versionKey(hash string, url string) string {
+	return s.key(hash + ":version:" + url)
+}
+
+func (s *redisStore) put(c *redisConn, err error) {
+	if err != nil && err != errRedisNil {
+		if _, ok := err.(redisError); !ok {
+			c.conn.Close()
+			return
+		}
+	}
+
+	select {
+	case s.pool <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// watch runs an optimistic transaction: keys are watched while prepare reads them
+// and returns the commands to execute, it is retried if any key was changed in between
+func (s *redisStore) watch(keys []string, prepare func(*redisConn) ([][]string, error)) error {
+	c, err := s.get()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < redisMaxRetries; i++ {
+		retry, err := s.watchOnce(c, keys, prepare)
+		if err != nil {
+			// the connection may still be watching or in a transaction
+			c.conn.Close()
+			return err
+		}
+		if !retry {
+			s.put(c, nil)
+			return nil
+		}
+	}
+
+	s.put(c, nil)
+	return errRedisRetries
+}
+
+func (s *redisStore) watchOnce(c *redisConn, keys []string, prepare func(*redisConn) ([][]string, error)) (bool, error) {
+	if len(keys) > 0 {
+		if _, err := c.do(append([]string{"WATCH"}, keys...)...); err != nil {
+			return false, err
+		}
+	}
+
+	commands, err := prepare(c)
+	if err != nil || commands == nil {
+		if len(keys) > 0 {
+			c.do("UNWATCH")
+		}
+		return false, err
+	}
+
+	if _, err := c.do("MULTI"); err != nil {
+		return false, err
+	}
+	for _, command := range commands {
+		if _, err := c.do(command...); err != nil {
+			c.do("DISCARD")
+			return false, err
+		}
+	}
+
+	_, err = c.do("EXEC")
+	if err == errRedisNil {
+		// one of the watched keys has been changed
+		return true, nil
+	}
+
+	return false, err
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if err := c.conn.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	return c.read()
+}
+
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, errRedisNil
+		}
+
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, errRedisNil
+		}
+
+		values := make([]interface{}, count)
+		for i := range values {
+			values[i], err = c.read()
+			if err == errRedisNil {
+				values[i] = nil
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+func parseRedisLease(value string) (string, time.Time) {
+	i := strings.LastIndex(value, " ")
+	if i < 0 {
+		return value, time.Time{}
+	}
+
+	expires, _ := strconv.ParseInt(value[i+1:], 10, 64)
+	return value[:i], time.Unix(0, expires)
+}
+
+func redisScore(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
@@ -0,0 +1,305 @@
+package store // import "github.com/daohoangson/go-deferred/pkg/store"
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SQL dialects
+const (
+	SQLDialectMySQL  = "mysql"
+	SQLDialectSQLite = "sqlite3"
+)
+
+// sqlBusyTimeout limits retries of SQLite writes while another connection holds the write lock
+const sqlBusyTimeout = 5 * time.Second
+
+type sqlStore struct {
+	db          *sql.DB
+	dialect     string
+	tablePrefix string
+}
+
+// NewSQL returns a Store backed by a SQL database, the schema is created if needed.
+// The dialect is SQLDialectMySQL (also for MariaDB) or SQLDialectSQLite, SQLite 3.24 or newer is required.
+// SQLite writes are retried for up to sqlBusyTimeout when the database is locked.
+func NewSQL(db *sql.DB, dialect string, tablePrefix string) (Store, error) {
+	if dialect != SQLDialectMySQL && dialect != SQLDialectSQLite {
+		return nil, fmt.Errorf("Unsupported SQL dialect %q", dialect)
+	}
+
+	s := &sqlStore{}
+	s.db = db
+	s.dialect = dialect
+	s.tablePrefix = tablePrefix
+
+	for _, query := range []string{
+		"CREATE TABLE IF NOT EXISTS " + s.table("queue") + ` (
+			url VARCHAR(255) NOT NULL PRIMARY KEY,
+			due_at BIGINT NOT NULL,
+			request_id VARCHAR(64) NOT NULL DEFAULT '',
+			priority INT NOT NULL DEFAULT 0
+		)`,
+		"CREATE TABLE IF NOT EXISTS " + s.table("leases") + ` (
+			lease_key VARCHAR(255) NOT NULL PRIMARY KEY,
+			holder VARCHAR(64) NOT NULL,
+			expires_at BIGINT NOT NULL
+		)`,
+		"CREATE TABLE IF NOT EXISTS " + s.table("stats") + ` (
+			url VARCHAR(255) NOT NULL PRIMARY KEY,
+			data TEXT NOT NULL
+		)`,
+	} {
+		if _, err := db.Exec(query); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *sqlStore) Enqueue(item Item, now time.Time) (bool, error) {
+	// a single upsert so that concurrent enqueues cannot conflict
+	var query string
+	var args []interface{}
+	if s.dialect == SQLDialectMySQL {
+		// the pending time is kept if it is between now and the new time,
+		// due_at is assigned last because later assignments see its new value
+		keep := "due_at > ? AND due_at < VALUES(due_at)"
+		query = "INSERT INTO " + s.table("queue") + " (url, due_at, request_id, priority) VALUES (?, ?, ?, ?)" +
+			" ON DUPLICATE KEY UPDATE" +
+			" request_id = IF(" + keep + ", request_id, VALUES(request_id))," +
+			" priority = IF(" + keep + ", priority, VALUES(priority))," +
+			" due_at = IF(" + keep + ", due_at, VALUES(due_at))"
+		args = []interface{}{item.URL, item.Time.UnixNano(), item.RequestID, item.Priority, now.UnixNano(), now.UnixNano(), now.UnixNano()}
+	} else {
+		query = "INSERT INTO " + s.table("queue") + " (url, due_at, request_id, priority) VALUES (?, ?, ?, ?)" +
+			" ON CONFLICT (url) DO UPDATE SET due_at = excluded.due_at, request_id = excluded.request_id, priority = excluded.priority" +
+			" WHERE NOT (" + s.table("queue") + ".due_at > ? AND " + s.table("queue") + ".due_at < excluded.due_at)"
+		args = []interface{}{item.URL, item.Time.UnixNano(), item.RequestID, item.Priority, now.UnixNano()}
+	}
+
+	result, err := s.exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+
+	// MySQL reports 0 for an unchanged row, the same item is already queued then
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *sqlStore) GetDue(t time.Time) ([]Item, error) {
+	return s.queryItems("SELECT url, due_at, request_id, priority FROM "+s.table("queue")+" WHERE due_at <= ?", t.UnixNano())
+}
+
+func (s *sqlStore) GetNext(cutOff time.Time) (time.Time, bool, error) {
+	var next sql.NullInt64
+	err := s.db.QueryRow("SELECT MIN(due_at) FROM "+s.table("queue")+" WHERE due_at > ?", cutOff.UnixNano()).Scan(&next)
+	if err != nil || !next.Valid {
+		return time.Time{}, false, err
+	}
+
+	return time.Unix(0, next.Int64), true, nil
+}
+
+func (s *sqlStore) GetQueued() ([]Item, error) {
+	return s.queryItems("SELECT url, due_at, request_id, priority FROM " + s.table("queue"))
+}
+
+func (s *sqlStore) GetStats(url string) (Stats, error) {
+	stats := Stats{}
+
+	var data string
+	err := s.db.QueryRow("SELECT data FROM "+s.table("stats")+" WHERE url = ?", url).Scan(&data)
+	if err == sql.ErrNoRows {
+		return stats, nil
+	}
+	if err != nil {
+		return stats, err
+	}
+
+	err = json.Unmarshal([]byte(data), &stats)
+	return stats, err
+}
+
+func (s *sqlStore) GetStatsAll() (map[string]Stats, error) {
+	rows, err := s.db.Query("SELECT url, data FROM " + s.table("stats"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	all := make(map[string]Stats)
+	for rows.Next() {
+		var url, data string
+		if err := rows.Scan(&url, &data); err != nil {
+			return nil, err
+		}
+
+		stats := Stats{}
+		if err := json.Unmarshal([]byte(data), &stats); err != nil {
+			return nil, err
+		}
+		all[url] = stats
+	}
+
+	return all, rows.Err()
+}
+
+func (s *sqlStore) Lock(key string, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	result, err := s.exec("UPDATE "+s.table("leases")+" SET holder = ?, expires_at = ?"+
+		" WHERE lease_key = ? AND (holder = ? OR expires_at <= ?)",
+		holder, now.Add(ttl).UnixNano(), key, holder, now.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected > 0 {
+		return err == nil, err
+	}
+
+	// the lease is missing or held by another holder, only one concurrent insert can succeed
+	result, err = s.exec(s.insertIgnore()+" INTO "+s.table("leases")+" (lease_key, holder, expires_at) VALUES (?, ?, ?)",
+		key, holder, now.Add(ttl).UnixNano())
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *sqlStore) Remove(url string) error {
+	_, err := s.exec("DELETE FROM "+s.table("queue")+" WHERE url = ?", url)
+	return err
+}
+
+func (s *sqlStore) Unlock(key string, holder string) error {
+	_, err := s.exec("DELETE FROM "+s.table("leases")+" WHERE lease_key = ? AND holder = ?", key, holder)
+	return err
+}
+
+func (s *sqlStore) UpdateStats(url string, update func(*Stats)) (Stats, error) {
+	// the row must exist to be locked, concurrent first updates would conflict otherwise
+	_, err := s.exec(s.insertIgnore()+" INTO "+s.table("stats")+" (url, data) VALUES (?, ?)", url, "{}")
+	if err != nil {
+		return Stats{}, err
+	}
+
+	var stats Stats
+	err = s.retry(func() error {
+		stats, err = s.updateStats(url, update)
+		return err
+	})
+
+	return stats, err
+}
+
+// exec runs a write query, retrying it while SQLite is busy
+func (s *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := s.retry(func() error {
+		var err error
+		result, err = s.db.Exec(query, args...)
+		return err
+	})
+
+	return result, err
+}
+
+// retry calls f again while it fails because another SQLite connection holds the write lock
+func (s *sqlStore) retry(f func() error) error {
+	deadline := time.Now().Add(sqlBusyTimeout)
+	wait := time.Millisecond
+	for {
+		err := f()
+		if err == nil || s.dialect != SQLDialectSQLite || !isSQLiteBusy(err) || time.Now().After(deadline) {
+			return err
+		}
+
+		time.Sleep(wait)
+		if wait < 50*time.Millisecond {
+			wait *= 2
+		}
+	}
+}
+
+func (s *sqlStore) updateStats(url string, update func(*Stats)) (Stats, error) {
+	stats := Stats{}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return stats, err
+	}
+	defer tx.Rollback()
+
+	var data string
+	if s.dialect == SQLDialectMySQL {
+		err = tx.QueryRow("SELECT data FROM "+s.table("stats")+" WHERE url = ? FOR UPDATE", url).Scan(&data)
+	} else {
+		// SQLite has no row locks, writing first takes the database write lock before reading
+		if _, err = tx.Exec("UPDATE "+s.table("stats")+" SET data = data WHERE url = ?", url); err == nil {
+			err = tx.QueryRow("SELECT data FROM "+s.table("stats")+" WHERE url = ?", url).Scan(&data)
+		}
+	}
+	if err != nil {
+		return stats, err
+	}
+	if err := json.Unmarshal([]byte(data), &stats); err != nil {
+		return stats, err
+	}
+
+	update(&stats)
+	updated, err := json.Marshal(stats)
+	if err != nil {
+		return stats, err
+	}
+
+	if _, err = tx.Exec("UPDATE "+s.table("stats")+" SET data = ? WHERE url = ?", string(updated), url); err != nil {
+		return stats, err
+	}
+
+	return stats, tx.Commit()
+}
+
+func (s *sqlStore) queryItems(query string, args ...interface{}) ([]Item, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []Item
+	for rows.Next() {
+		item := Item{}
+		var dueAt int64
+		if err := rows.Scan(&item.URL, &dueAt, &item.RequestID, &item.Priority); err != nil {
+			return nil, err
+		}
+		item.Time = time.Unix(0, dueAt)
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+func (s *sqlStore) insertIgnore() string {
+	if s.dialect == SQLDialectMySQL {
+		return "INSERT IGNORE"
+	}
+
+	return "INSERT OR IGNORE"
+}
+
+func (s *sqlStore) table(name string) string {
+	return s.tablePrefix + name
+}
+
+// isSQLiteBusy checks the message as the store does not depend on a particular driver
+func isSQLiteBusy(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "database is locked") || strings.Contains(message, "database table is locked")
+}
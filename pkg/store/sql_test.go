@@ -0,0 +1,64 @@
+package store // import "github.com/daohoangson/go-deferred/pkg/store"
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// the driver waits for the write lock by default, concurrent writes must not rely on it
+	db, err := sql.Open(SQLDialectSQLite, "file:"+filepath.Join(dir, "store.db")+"?_busy_timeout=0")
+	assert.Nil(t, err)
+	defer db.Close()
+
+	s, err := NewSQL(db, SQLDialectSQLite, "test_")
+	assert.Nil(t, err)
+	testStore(t, s)
+	testLocker(t, s.(Locker))
+
+	queued, _ := s.GetQueued()
+	assert.Equal(t, "req-b", queued[0].RequestID)
+
+	now := time.Date(2018, time.June, 19, 0, 0, 0, 0, time.UTC)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	claimed := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(holder string) {
+			defer wg.Done()
+
+			for j := 0; j < 10; j++ {
+				_, err := s.UpdateStats("c", func(stats *Stats) { stats.CounterWakeUps++ })
+				assert.Nil(t, err)
+				_, err = s.Enqueue(Item{URL: "c", Time: now}, now)
+				assert.Nil(t, err)
+			}
+			if locked, _ := s.(Locker).Lock("c", holder, now, time.Minute); locked {
+				mutex.Lock()
+				claimed++
+				mutex.Unlock()
+			}
+		}(string(rune('a' + i)))
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, claimed)
+	stats, _ := s.GetStats("c")
+	assert.Equal(t, uint64(100), stats.CounterWakeUps)
+
+	_, err = NewSQL(db, "postgres", "")
+	assert.NotNil(t, err)
+}
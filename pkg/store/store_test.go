@@ -0,0 +1,276 @@
+package store // import "github.com/daohoangson/go-deferred/pkg/store"
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daohoangson/go-deferred/pkg/testserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory())
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.jsonl")
+
+	s, err := NewFile(path)
+	assert.Nil(t, err)
+	testStore(t, s)
+
+	reopened, err := NewFile(path)
+	assert.Nil(t, err)
+
+	queued, _ := reopened.GetQueued()
+	assert.Equal(t, 1, len(queued))
+	assert.Equal(t, "b", queued[0].URL)
+	assert.Equal(t, "req-b", queued[0].RequestID)
+
+	stats, _ := reopened.GetStats("a")
+	assert.Equal(t, uint64(2), stats.CounterEnqueues)
+}
+
+func TestFileCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.jsonl")
+
+	s, err := NewFile(path)
+	assert.Nil(t, err)
+	for i := 0; i < fileCompactThreshold*2; i++ {
+		s.UpdateStats("a", func(stats *Stats) { stats.CounterLoops++ })
+	}
+
+	f := s.(*file)
+	assert.True(t, f.records <= fileCompactThreshold+1)
+
+	reopened, err := NewFile(path)
+	assert.Nil(t, err)
+	stats, _ := reopened.GetStats("a")
+	assert.Equal(t, uint64(fileCompactThreshold*2), stats.CounterLoops)
+}
+
+func TestFileWriteError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	now := time.Date(2018, time.June, 19, 0, 0, 0, 0, time.UTC)
+
+	s, err := NewFile(filepath.Join(dir, "store.jsonl"))
+	assert.Nil(t, err)
+	s.(*file).file.Close()
+
+	// memory is left unchanged when the journal cannot be written
+	stored, err := s.Enqueue(Item{URL: "a", Time: now}, now)
+	assert.NotNil(t, err)
+	assert.False(t, stored)
+	queued, _ := s.GetQueued()
+	assert.Equal(t, 0, len(queued))
+
+	_, err = s.UpdateStats("a", func(stats *Stats) { stats.CounterLoops++ })
+	assert.NotNil(t, err)
+	stats, _ := s.GetStats("a")
+	assert.Equal(t, uint64(0), stats.CounterLoops)
+}
+
+func TestMemoryLock(t *testing.T) {
+	testLocker(t, NewMemory().(Locker))
+}
+
+func TestRedis(t *testing.T) {
+	server := testserver.NewRedis()
+	defer server.Close()
+
+	s, err := NewRedis(server.GetAddress(), "test:")
+	assert.Nil(t, err)
+	testStore(t, s)
+
+	reconnected, err := NewRedis("redis://:secret@"+server.GetAddress()+"/0", "test:")
+	assert.Nil(t, err)
+	queued, _ := reconnected.GetQueued()
+	assert.Equal(t, 1, len(queued))
+	assert.Equal(t, "req-b", queued[0].RequestID)
+
+	testLocker(t, s.(Locker))
+}
+
+func TestRedisClaim(t *testing.T) {
+	server := testserver.NewRedis()
+	defer server.Close()
+	now := time.Date(2018, time.June, 19, 0, 0, 0, 0, time.UTC)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	claimed := 0
+	for i := 0; i < 10; i++ {
+		s, err := NewRedis(server.GetAddress(), "")
+		assert.Nil(t, err)
+
+		wg.Add(1)
+		go func(s Store, holder string) {
+			defer wg.Done()
+
+			s.UpdateStats("a", func(stats *Stats) { stats.CounterWakeUps++ })
+			if locked, _ := s.(Locker).Lock("a", holder, now, time.Minute); locked {
+				mutex.Lock()
+				claimed++
+				mutex.Unlock()
+			}
+		}(s, string(rune('a'+i)))
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, claimed)
+
+	s, _ := NewRedis(server.GetAddress(), "")
+	stats, _ := s.GetStats("a")
+	assert.Equal(t, uint64(10), stats.CounterWakeUps)
+}
+
+func TestRedisTargets(t *testing.T) {
+	server := testserver.NewRedis()
+	defer server.Close()
+	now := time.Date(2018, time.June, 19, 0, 0, 0, 0, time.UTC)
+
+	// writes for different targets do not interrupt each other
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		s, err := NewRedis(server.GetAddress(), "")
+		assert.Nil(t, err)
+
+		wg.Add(1)
+		go func(s Store, url string) {
+			defer wg.Done()
+
+			for j := 0; j < 10; j++ {
+				_, err := s.UpdateStats(url, func(stats *Stats) { stats.CounterWakeUps++ })
+				assert.Nil(t, err)
+				_, err = s.Enqueue(Item{URL: url, Time: now.Add(-time.Duration(j) * time.Second)}, now)
+				assert.Nil(t, err)
+			}
+		}(s, string(rune('a'+i)))
+	}
+	wg.Wait()
+
+	execs := 0
+	for _, command := range server.GetCommands() {
+		if command == "EXEC" {
+			execs++
+		}
+	}
+	assert.Equal(t, 200, execs)
+
+	s, _ := NewRedis(server.GetAddress(), "")
+	all, _ := s.GetStatsAll()
+	assert.Equal(t, 10, len(all))
+	assert.Equal(t, uint64(10), all["a"].CounterWakeUps)
+}
+
+func TestRedisTimeout(t *testing.T) {
+	// the server accepts connections but never replies
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	defer func(timeout time.Duration) { redisTimeout = timeout }(redisTimeout)
+	redisTimeout = 100 * time.Millisecond
+
+	_, err = NewRedis(listener.Addr().String(), "")
+	assert.NotNil(t, err)
+}
+
+func testLocker(t *testing.T, l Locker) {
+	now := time.Date(2018, time.June, 19, 0, 0, 0, 0, time.UTC)
+
+	locked, err := l.Lock("a", "node1", now, time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, locked)
+
+	locked, _ = l.Lock("a", "node2", now, time.Minute)
+	assert.False(t, locked)
+
+	// the same holder can renew
+	locked, _ = l.Lock("a", "node1", now.Add(time.Second), time.Minute)
+	assert.True(t, locked)
+
+	// another holder takes over after expiry
+	locked, _ = l.Lock("a", "node2", now.Add(2*time.Minute), time.Minute)
+	assert.True(t, locked)
+
+	// unlock by a non-holder is ignored
+	assert.Nil(t, l.Unlock("a", "node1"))
+	locked, _ = l.Lock("a", "node1", now.Add(2*time.Minute), time.Minute)
+	assert.False(t, locked)
+
+	assert.Nil(t, l.Unlock("a", "node2"))
+	locked, _ = l.Lock("a", "node1", now.Add(2*time.Minute), time.Minute)
+	assert.True(t, locked)
+}
+
+func testStore(t *testing.T, s Store) {
+	now := time.Date(2018, time.June, 19, 0, 0, 0, 0, time.UTC)
+
+	stored, err := s.Enqueue(Item{URL: "a", Time: now.Add(time.Minute)}, now)
+	assert.Nil(t, err)
+	assert.True(t, stored)
+
+	// a later time is skipped while an earlier one is pending
+	stored, _ = s.Enqueue(Item{URL: "a", Time: now.Add(time.Hour)}, now)
+	assert.False(t, stored)
+
+	// an earlier time replaces the pending one
+	stored, _ = s.Enqueue(Item{URL: "a", Time: now}, now)
+	assert.True(t, stored)
+
+	stored, _ = s.Enqueue(Item{URL: "b", Time: now.Add(time.Second), RequestID: "req-b", Priority: 3}, now)
+	assert.True(t, stored)
+
+	due, err := s.GetDue(now)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(due))
+	assert.Equal(t, "a", due[0].URL)
+
+	next, ok, err := s.GetNext(now)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.True(t, next.Equal(now.Add(time.Second)))
+
+	_, ok, _ = s.GetNext(now.Add(time.Second))
+	assert.False(t, ok)
+
+	for i := 0; i < 2; i++ {
+		stats, err := s.UpdateStats("a", func(stats *Stats) { stats.CounterEnqueues++ })
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(i+1), stats.CounterEnqueues)
+	}
+
+	all, err := s.GetStatsAll()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(all))
+
+	assert.Nil(t, s.Remove("a"))
+	queued, err := s.GetQueued()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(queued))
+	assert.Equal(t, "b", queued[0].URL)
+	assert.Equal(t, 3, queued[0].Priority)
+}
@@ -0,0 +1,52 @@
+package testserver // import "github.com/daohoangson/go-deferred/pkg/testserver"
+import "time"
+
+// Server represents a fake XenForo server with deferred.php and job.php
+type Server interface {
+	AddJobs(count int)
+	Close()
+	GetDeferredURL() string
+	GetJobURL() string
+	GetPendingJobs() int
+	GetRequests() []Request
+	SetConfig(config Config)
+}
+
+// Config represents how the server responds
+type Config struct {
+	// Delay is applied before each response
+	Delay time.Duration
+
+	// Enqueue is sent as the go-deferred enqueue header if set
+	Enqueue *int64
+
+	// EnqueueHeader is sent as the enqueue header as is, it takes precedence over Enqueue
+	EnqueueHeader string
+
+	// JobsPerRequest is the number of jobs drained per request, zero is the same as one
+	JobsPerRequest int
+
+	// Malformed makes the server respond with a body that is not JSON
+	Malformed bool
+
+	// ProtocolVersion is sent as the go-deferred version header if set
+	ProtocolVersion string
+
+	// Progress adds the pending jobs and the ones that ran to the response
+	Progress bool
+}
+
+// Request represents a request received by the server
+type Request struct {
+	Path            string
+	ProtocolVersion string
+	TimeStart       time.Time
+}
+
+// RedisServer represents an in-process stand-in for a Redis server,
+// it speaks enough of the protocol for the store package
+type RedisServer interface {
+	Close()
+	GetAddress() string
+	GetCommands() []string
+}
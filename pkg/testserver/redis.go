@@ -0,0 +1,547 @@
+package testserver // import "github.com/daohoangson/go-deferred/pkg/testserver"
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type redisServer struct {
+	listener net.Listener
+
+	mutex    sync.Mutex
+	commands []string
+	hashes   map[string]map[string]string
+	values   map[string]redisString
+	versions map[string]uint64
+	zsets    map[string]map[string]float64
+}
+
+type redisString struct {
+	value   string
+	expires time.Time
+}
+
+type redisClient struct {
+	multi   bool
+	queued  [][]string
+	watched map[string]uint64
+}
+
+type redisStatus string
+type redisError string
+type redisNil struct{}
+type redisNilArray struct{}
+
+// NewRedis starts a new RedisServer instance on a random local port
+func NewRedis() RedisServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("testserver: failed to listen: %v", err))
+	}
+
+	s := &redisServer{}
+	s.listener = listener
+	s.hashes = make(map[string]map[string]string)
+	s.values = make(map[string]redisString)
+	s.versions = make(map[string]uint64)
+	s.zsets = make(map[string]map[string]float64)
+
+	go s.accept()
+
+	return s
+}
+
+func (s *redisServer) Close() {
+	s.listener.Close()
+}
+
+func (s *redisServer) GetAddress() string {
+	return s.listener.Addr().String()
+}
+
+func (s *redisServer) GetCommands() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	commands := make([]string, len(s.commands))
+	copy(commands, s.commands)
+	return commands
+}
+
+func (s *redisServer) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.serve(conn)
+	}
+}
+
+func (s *redisServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	client := &redisClient{}
+	for {
+		args, err := readRedisCommand(reader)
+		if err != nil {
+			return
+		}
+
+		reply := s.handle(client, args)
+		if _, err := io.WriteString(conn, formatRedisReply(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *redisServer) handle(client *redisClient, args []string) interface{} {
+	if len(args) == 0 {
+		return redisError("ERR empty command")
+	}
+	name := strings.ToUpper(args[0])
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.commands = append(s.commands, name)
+
+	switch name {
+	case "MULTI":
+		client.multi = true
+		client.queued = nil
+		return redisStatus("OK")
+	case "EXEC":
+		if !client.multi {
+			return redisError("ERR EXEC without MULTI")
+		}
+		queued := client.queued
+		watched := client.watched
+		client.multi = false
+		client.queued = nil
+		client.watched = nil
+
+		for key, version := range watched {
+			if s.versions[key] != version {
+				return redisNilArray{}
+			}
+		}
+
+		replies := make([]interface{}, len(queued))
+		for i, queuedArgs := range queued {
+			replies[i] = s.execute(queuedArgs)
+		}
+		return replies
+	case "DISCARD":
+		client.multi = false
+		client.queued = nil
+		client.watched = nil
+		return redisStatus("OK")
+	case "WATCH":
+		if client.watched == nil {
+			client.watched = make(map[string]uint64)
+		}
+		for _, key := range args[1:] {
+			client.watched[key] = s.versions[key]
+		}
+		return redisStatus("OK")
+	case "UNWATCH":
+		client.watched = nil
+		return redisStatus("OK")
+	}
+
+	if client.multi {
+		client.queued = append(client.queued, args)
+		return redisStatus("QUEUED")
+	}
+
+	return s.execute(args)
+}
+
+func (s *redisServer) execute(args []string) interface{} {
+	name := strings.ToUpper(args[0])
+	args = args[1:]
+
+	switch name {
+	case "AUTH", "SELECT":
+		return redisStatus("OK")
+	case "PING":
+		return redisStatus("PONG")
+	case "DEL":
+		var deleted int64
+		for _, key := range args {
+			if s.exists(key) {
+				delete(s.hashes, key)
+				delete(s.values, key)
+				delete(s.zsets, key)
+				s.touch(key)
+				deleted++
+			}
+		}
+		return deleted
+	case "GET":
+		if len(args) != 1 {
+			return redisError("ERR wrong number of arguments")
+		}
+		str, ok := s.getString(args[0])
+		if !ok {
+			return redisNil{}
+		}
+		return str.value
+	case "SET":
+		return s.set(args)
+	case "INCR":
+		if len(args) != 1 {
+			return redisError("ERR wrong number of arguments")
+		}
+		str, _ := s.getString(args[0])
+		value, err := strconv.ParseInt("0"+str.value, 10, 64)
+		if err != nil {
+			return redisError("ERR value is not an integer or out of range")
+		}
+		value++
+		s.values[args[0]] = redisString{value: strconv.FormatInt(value, 10), expires: str.expires}
+		s.touch(args[0])
+		return value
+	case "HDEL":
+		if len(args) < 2 {
+			return redisError("ERR wrong number of arguments")
+		}
+		var deleted int64
+		for _, field := range args[1:] {
+			if _, ok := s.hashes[args[0]][field]; ok {
+				delete(s.hashes[args[0]], field)
+				deleted++
+			}
+		}
+		if deleted > 0 {
+			s.touch(args[0])
+		}
+		return deleted
+	case "HGET":
+		if len(args) != 2 {
+			return redisError("ERR wrong number of arguments")
+		}
+		value, ok := s.hashes[args[0]][args[1]]
+		if !ok {
+			return redisNil{}
+		}
+		return value
+	case "HGETALL":
+		if len(args) != 1 {
+			return redisError("ERR wrong number of arguments")
+		}
+		fields := make([]string, 0, len(s.hashes[args[0]]))
+		for field := range s.hashes[args[0]] {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		values := make([]interface{}, 0, len(fields)*2)
+		for _, field := range fields {
+			values = append(values, field, s.hashes[args[0]][field])
+		}
+		return values
+	case "HMGET":
+		if len(args) < 2 {
+			return redisError("ERR wrong number of arguments")
+		}
+		values := make([]interface{}, len(args)-1)
+		for i, field := range args[1:] {
+			if value, ok := s.hashes[args[0]][field]; ok {
+				values[i] = value
+			} else {
+				values[i] = redisNil{}
+			}
+		}
+		return values
+	case "HSET":
+		if len(args) < 3 || len(args)%2 == 0 {
+			return redisError("ERR wrong number of arguments")
+		}
+		if s.hashes[args[0]] == nil {
+			s.hashes[args[0]] = make(map[string]string)
+		}
+		var added int64
+		for i := 1; i+1 < len(args); i += 2 {
+			if _, ok := s.hashes[args[0]][args[i]]; !ok {
+				added++
+			}
+			s.hashes[args[0]][args[i]] = args[i+1]
+		}
+		s.touch(args[0])
+		return added
+	case "ZADD":
+		if len(args) < 3 || len(args)%2 == 0 {
+			return redisError("ERR wrong number of arguments")
+		}
+		if s.zsets[args[0]] == nil {
+			s.zsets[args[0]] = make(map[string]float64)
+		}
+		var added int64
+		for i := 1; i+1 < len(args); i += 2 {
+			score, err := strconv.ParseFloat(args[i], 64)
+			if err != nil {
+				return redisError("ERR value is not a valid float")
+			}
+			if _, ok := s.zsets[args[0]][args[i+1]]; !ok {
+				added++
+			}
+			s.zsets[args[0]][args[i+1]] = score
+		}
+		s.touch(args[0])
+		return added
+	case "ZRANGE":
+		if len(args) != 3 {
+			return redisError("ERR wrong number of arguments")
+		}
+		members := s.sortedMembers(args[0])
+		start, _ := strconv.Atoi(args[1])
+		stop, _ := strconv.Atoi(args[2])
+		if start < 0 {
+			start += len(members)
+		}
+		if stop < 0 {
+			stop += len(members)
+		}
+		values := []interface{}{}
+		for i := start; i <= stop && i < len(members); i++ {
+			if i >= 0 {
+				values = append(values, members[i])
+			}
+		}
+		return values
+	case "ZRANGEBYSCORE":
+		return s.zrangeByScore(args)
+	case "ZREM":
+		if len(args) < 2 {
+			return redisError("ERR wrong number of arguments")
+		}
+		var removed int64
+		for _, member := range args[1:] {
+			if _, ok := s.zsets[args[0]][member]; ok {
+				delete(s.zsets[args[0]], member)
+				removed++
+			}
+		}
+		if removed > 0 {
+			s.touch(args[0])
+		}
+		return removed
+	}
+
+	return redisError(fmt.Sprintf("ERR unknown command '%s'", name))
+}
+
+func (s *redisServer) exists(key string) bool {
+	if _, ok := s.getString(key); ok {
+		return true
+	}
+	if len(s.hashes[key]) > 0 {
+		return true
+	}
+	return len(s.zsets[key]) > 0
+}
+
+func (s *redisServer) getString(key string) (redisString, bool) {
+	str, ok := s.values[key]
+	if !ok {
+		return str, false
+	}
+
+	if !str.expires.IsZero() && !time.Now().Before(str.expires) {
+		delete(s.values, key)
+		s.touch(key)
+		return str, false
+	}
+
+	return str, true
+}
+
+func (s *redisServer) set(args []string) interface{} {
+	if len(args) < 2 {
+		return redisError("ERR wrong number of arguments")
+	}
+
+	str := redisString{value: args[1]}
+	nx := false
+	xx := false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "PX":
+			if i+1 >= len(args) {
+				return redisError("ERR syntax error")
+			}
+			ms, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || ms <= 0 {
+				return redisError("ERR invalid expire time")
+			}
+			str.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			i++
+		default:
+			return redisError("ERR syntax error")
+		}
+	}
+
+	_, exists := s.getString(args[0])
+	if (nx && exists) || (xx && !exists) {
+		return redisNil{}
+	}
+
+	s.values[args[0]] = str
+	s.touch(args[0])
+	return redisStatus("OK")
+}
+
+func (s *redisServer) sortedMembers(key string) []string {
+	zset := s.zsets[key]
+	members := make([]string, 0, len(zset))
+	for member := range zset {
+		members = append(members, member)
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		if zset[members[i]] != zset[members[j]] {
+			return zset[members[i]] < zset[members[j]]
+		}
+		return members[i] < members[j]
+	})
+
+	return members
+}
+
+func (s *redisServer) touch(key string) {
+	s.versions[key]++
+}
+
+func (s *redisServer) zrangeByScore(args []string) interface{} {
+	if len(args) != 3 && len(args) != 6 {
+		return redisError("ERR wrong number of arguments")
+	}
+
+	min, err1 := parseRedisScore(args[1])
+	max, err2 := parseRedisScore(args[2])
+	if err1 != nil || err2 != nil {
+		return redisError("ERR min or max is not a float")
+	}
+
+	offset, count := 0, -1
+	if len(args) == 6 {
+		if strings.ToUpper(args[3]) != "LIMIT" {
+			return redisError("ERR syntax error")
+		}
+		offset, _ = strconv.Atoi(args[4])
+		count, _ = strconv.Atoi(args[5])
+	}
+
+	values := []interface{}{}
+	for _, member := range s.sortedMembers(args[0]) {
+		score := s.zsets[args[0]][member]
+		if score < min || score > max {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if count == 0 {
+			break
+		}
+
+		values = append(values, member)
+		count--
+	}
+
+	return values
+}
+
+func formatRedisReply(reply interface{}) string {
+	switch r := reply.(type) {
+	case redisStatus:
+		return "+" + string(r) + "\r\n"
+	case redisError:
+		return "-" + string(r) + "\r\n"
+	case redisNil:
+		return "$-1\r\n"
+	case redisNilArray:
+		return "*-1\r\n"
+	case int64:
+		return ":" + strconv.FormatInt(r, 10) + "\r\n"
+	case string:
+		return "$" + strconv.Itoa(len(r)) + "\r\n" + r + "\r\n"
+	case []interface{}:
+		var b strings.Builder
+		b.WriteString("*" + strconv.Itoa(len(r)) + "\r\n")
+		for _, value := range r {
+			b.WriteString(formatRedisReply(value))
+		}
+		return b.String()
+	}
+
+	return "-ERR unexpected reply\r\n"
+}
+
+func parseRedisScore(value string) (float64, error) {
+	switch value {
+	case "-inf":
+		return math.Inf(-1), nil
+	case "+inf", "inf":
+		return math.Inf(1), nil
+	}
+
+	return strconv.ParseFloat(value, 64)
+}
+
+func readRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	if !strings.HasPrefix(line, "*") {
+		// inline command
+		return strings.Fields(line), nil
+	}
+
+	count, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, count)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("testserver: unexpected %q", line)
+		}
+
+		size, err := strconv.Atoi(strings.TrimRight(line[1:], "\r\n"))
+		if err != nil {
+			return nil, err
+		}
+
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+
+	return args, nil
+}
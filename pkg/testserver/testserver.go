@@ -0,0 +1,152 @@
+package testserver // import "github.com/daohoangson/go-deferred/pkg/testserver"
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/daohoangson/go-deferred/internal"
+)
+
+type server struct {
+	httpServer *httptest.Server
+
+	mutex    sync.Mutex
+	config   Config
+	jobs     int
+	requests []Request
+}
+
+// New starts a new Server instance with some pending jobs
+func New(jobs int) Server {
+	s := &server{}
+	s.jobs = jobs
+	s.httpServer = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *server) AddJobs(count int) {
+	s.mutex.Lock()
+	s.jobs += count
+	s.mutex.Unlock()
+}
+
+func (s *server) Close() {
+	s.httpServer.Close()
+}
+
+func (s *server) GetDeferredURL() string {
+	return s.httpServer.URL + "/deferred.php"
+}
+
+func (s *server) GetJobURL() string {
+	return s.httpServer.URL + "/job.php"
+}
+
+func (s *server) GetPendingJobs() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.jobs
+}
+
+func (s *server) GetRequests() []Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	requests := make([]Request, len(s.requests))
+	copy(requests, s.requests)
+	return requests
+}
+
+func (s *server) SetConfig(config Config) {
+	s.mutex.Lock()
+	s.config = config
+	s.mutex.Unlock()
+}
+
+func (s *server) drain() (Config, int, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	jobsPerRequest := s.config.JobsPerRequest
+	if jobsPerRequest < 1 {
+		jobsPerRequest = 1
+	}
+
+	ran := jobsPerRequest
+	if ran > s.jobs {
+		ran = s.jobs
+	}
+	s.jobs -= ran
+
+	return s.config, ran, s.jobs
+}
+
+func (s *server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	s.requests = append(s.requests, Request{
+		Path:            r.URL.Path,
+		ProtocolVersion: r.Header.Get(internal.GetProtocolVersionHeaderKey()),
+		TimeStart:       time.Now(),
+	})
+	s.mutex.Unlock()
+
+	if r.Method != "POST" {
+		internal.RespondCode(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var moreKey string
+	switch r.URL.Path {
+	case "/deferred.php":
+		moreKey = "moreDeferred"
+	case "/job.php":
+		moreKey = "more"
+	default:
+		internal.RespondCode(w, http.StatusNotFound)
+		return
+	}
+
+	config, ran, pending := s.drain()
+	if config.Delay > 0 {
+		time.Sleep(config.Delay)
+	}
+
+	if len(config.EnqueueHeader) > 0 {
+		w.Header().Set(internal.GetProtocolEnqueueHeaderKey(), config.EnqueueHeader)
+	} else if config.Enqueue != nil {
+		w.Header().Set(internal.GetProtocolEnqueueHeaderKey(), strconv.FormatInt(*config.Enqueue, 10))
+	}
+
+	if len(config.ProtocolVersion) > 0 {
+		w.Header().Set(internal.GetProtocolVersionHeaderKey(), config.ProtocolVersion)
+	}
+
+	if config.Malformed {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html><body>Fatal error</body></html>")
+		return
+	}
+
+	body := map[string]interface{}{
+		moreKey: pending > 0,
+	}
+	if ran > 0 {
+		body["message"] = fmt.Sprintf("Ran %d jobs, %d pending", ran, pending)
+	}
+	if config.Progress {
+		jobs := make([]map[string]interface{}, ran)
+		for i := range jobs {
+			jobs[i] = map[string]interface{}{"name": "Job", "duration": 0.5}
+		}
+		body["progress"] = map[string]interface{}{"remaining": pending, "jobs": jobs}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,191 @@
+package testserver // import "github.com/daohoangson/go-deferred/pkg/testserver"
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/daohoangson/go-deferred/internal"
+	"github.com/daohoangson/go-deferred/pkg/cassette"
+	"github.com/daohoangson/go-deferred/pkg/runner"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeferred(t *testing.T) {
+	s := New(3)
+	defer s.Close()
+	r := runner.New(nil, nil)
+
+	hits, err := runner.Loop(r, s.GetDeferredURL())
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(hits.List))
+	assert.True(t, hits.List[0].Data.MoreDeferred)
+	assert.False(t, hits.List[2].Data.MoreDeferred)
+	assert.Equal(t, runner.StopReasonNoMore, hits.StopReason)
+	assert.Equal(t, 0, s.GetPendingJobs())
+
+	for _, request := range s.GetRequests() {
+		assert.Equal(t, "/deferred.php", request.Path)
+		assert.Equal(t, internal.GetProtocolVersion(), request.ProtocolVersion)
+	}
+}
+
+func TestJob(t *testing.T) {
+	s := New(4)
+	defer s.Close()
+	s.SetConfig(Config{JobsPerRequest: 2})
+	r := runner.New(nil, nil)
+
+	hits, err := runner.Loop(r, s.GetJobURL())
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(hits.List))
+	assert.True(t, hits.List[0].Data.More)
+	assert.False(t, hits.List[0].Data.MoreDeferred)
+	assert.Equal(t, 0, s.GetPendingJobs())
+}
+
+func TestEnqueue(t *testing.T) {
+	s := New(0)
+	defer s.Close()
+	enqueue := int64(42)
+	s.SetConfig(Config{Enqueue: &enqueue})
+	r := runner.New(nil, nil)
+
+	hit, err := r.Hit(s.GetDeferredURL())
+
+	assert.Nil(t, err)
+	assert.True(t, hit.HasEnqueue)
+	assert.Equal(t, enqueue, hit.Enqueue)
+}
+
+func TestProtocolVersion(t *testing.T) {
+	s := New(0)
+	defer s.Close()
+	r := runner.New(nil, nil)
+
+	hits, err := runner.Loop(r, s.GetDeferredURL())
+	assert.Nil(t, err)
+	assert.Equal(t, "", hits.ProtocolVersion)
+
+	s.SetConfig(Config{ProtocolVersion: "2018061901"})
+	hits, err = runner.Loop(r, s.GetDeferredURL())
+	assert.Nil(t, err)
+	assert.Equal(t, "2018061901", hits.ProtocolVersion)
+	assert.False(t, internal.HasProtocolFeature(hits.ProtocolVersion, internal.ProtocolFeatureProgress))
+
+	// newer targets are treated as ours
+	s.SetConfig(Config{ProtocolVersion: "9999999999"})
+	hits, err = runner.Loop(r, s.GetDeferredURL())
+	assert.Nil(t, err)
+	assert.Equal(t, internal.GetProtocolVersion(), hits.ProtocolVersion)
+	assert.True(t, internal.HasProtocolFeature(hits.ProtocolVersion, internal.ProtocolFeatureProgress))
+}
+
+func TestProgress(t *testing.T) {
+	s := New(3)
+	defer s.Close()
+	s.SetConfig(Config{JobsPerRequest: 2, Progress: true})
+	r := runner.New(nil, nil)
+
+	// targets without the version header do not get progress reporting
+	hit, err := r.Hit(s.GetDeferredURL())
+	assert.Nil(t, err)
+	assert.Nil(t, hit.Data.Progress)
+
+	s.SetConfig(Config{Progress: true, ProtocolVersion: internal.GetProtocolVersion()})
+	hit, err = r.Hit(s.GetDeferredURL())
+	assert.Nil(t, err)
+	if assert.NotNil(t, hit.Data.Progress) {
+		assert.Equal(t, 1, len(hit.Data.Progress.Jobs))
+		assert.Equal(t, "Job", hit.Data.Progress.Jobs[0].Name)
+		if assert.NotNil(t, hit.Data.Progress.Remaining) {
+			assert.Equal(t, uint64(0), *hit.Data.Progress.Remaining)
+		}
+	}
+}
+
+func TestEnqueueHint(t *testing.T) {
+	s := New(0)
+	defer s.Close()
+	s.SetConfig(Config{EnqueueHeader: "delay=42; priority=5"})
+	r := runner.New(nil, nil)
+
+	// older targets can only send seconds
+	hit, err := r.Hit(s.GetDeferredURL())
+	assert.Nil(t, err)
+	assert.False(t, hit.HasEnqueue)
+	assert.Nil(t, hit.EnqueueHint)
+
+	s.SetConfig(Config{EnqueueHeader: "delay=42; priority=5", ProtocolVersion: internal.GetProtocolVersion()})
+	hit, err = r.Hit(s.GetDeferredURL())
+	assert.Nil(t, err)
+	assert.True(t, hit.HasEnqueue)
+	assert.Equal(t, int64(42), hit.Enqueue)
+	if assert.NotNil(t, hit.EnqueueHint) {
+		assert.Equal(t, 5, hit.EnqueueHint.Priority)
+	}
+
+	s.SetConfig(Config{EnqueueHeader: "stop", ProtocolVersion: internal.GetProtocolVersion()})
+	hit, err = r.Hit(s.GetDeferredURL())
+	assert.Nil(t, err)
+	assert.False(t, hit.HasEnqueue)
+	if assert.NotNil(t, hit.EnqueueHint) {
+		assert.True(t, hit.EnqueueHint.Stop)
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	s := New(1)
+	defer s.Close()
+	s.SetConfig(Config{Malformed: true})
+	r := runner.New(nil, nil)
+
+	_, err := r.Hit(s.GetDeferredURL())
+
+	assert.NotNil(t, err)
+}
+
+func TestSlow(t *testing.T) {
+	s := New(1)
+	defer s.Close()
+	s.SetConfig(Config{Delay: time.Second / 4})
+	client := &http.Client{Timeout: time.Second / 10}
+	r := runner.New(client, nil)
+
+	_, err := r.Hit(s.GetDeferredURL())
+
+	assert.NotNil(t, err)
+
+	// the job still ran on the server side
+	assert.Equal(t, 0, s.GetPendingJobs())
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testserver")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cassette.jsonl")
+
+	s := New(2)
+	url := s.GetJobURL()
+	recorder, err := cassette.NewRecorder(path, nil)
+	assert.Nil(t, err)
+	recorded, err := runner.Loop(runner.New(&http.Client{Transport: recorder}, nil), url)
+	assert.Nil(t, err)
+	s.Close()
+
+	replayer, err := cassette.NewReplayer(path, false)
+	assert.Nil(t, err)
+	replayed, err := runner.Loop(runner.New(&http.Client{Transport: replayer}, nil), url)
+	assert.Nil(t, err)
+
+	assert.Equal(t, len(recorded.List), len(replayed.List))
+	for i, hit := range replayed.List {
+		assert.Equal(t, recorded.List[i].Data, hit.Data)
+	}
+}